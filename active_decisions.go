@@ -0,0 +1,275 @@
+package csbouncer
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+)
+
+type activeKey struct {
+	key storeKey
+	id  string
+}
+
+type activeLabels struct {
+	origin string
+	scope  string
+	typ    string
+}
+
+// usageKey identifies an active_decisions item of the usage metrics.
+type usageKey struct {
+	origin string
+	unit   string
+	ipType string
+}
+
+type activeDecision struct {
+	decision *models.Decision
+	labels   activeLabels
+	usage    usageKey
+}
+
+// activeDecisions counts the decisions delivered by StreamBouncer, by origin, scope and type,
+// and keeps the gauge up to date.
+type activeDecisions struct {
+	mu        sync.Mutex
+	decisions map[activeKey]activeDecision
+	counts    map[activeLabels]int
+	usage     map[usageKey]int
+	gauge     *prometheus.GaugeVec
+}
+
+func newActiveDecisions(gauge *prometheus.GaugeVec) *activeDecisions {
+	return &activeDecisions{
+		decisions: make(map[activeKey]activeDecision),
+		counts:    make(map[activeLabels]int),
+		usage:     make(map[usageKey]int),
+		gauge:     gauge,
+	}
+}
+
+// decisionOrigin returns the origin of a decision as reported in the metrics, with the name
+// of the list for the decisions of the blocklists.
+func decisionOrigin(d *models.Decision) string {
+	origin := deref(d.Origin)
+	if origin == types.ListOrigin {
+		origin += ":" + deref(d.Scenario)
+	}
+
+	return origin
+}
+
+// newUsageKey returns the active_decisions item of a decision, like the firewall bouncer
+// reports it: the decisions on IP addresses and ranges are counted together, by IP version.
+func newUsageKey(d *models.Decision, origin string) usageKey {
+	unit := normalizeScope(deref(d.Scope))
+	if unit == normalizeScope(types.Range) {
+		unit = normalizeScope(types.Ip)
+	}
+
+	key := usageKey{origin: origin, unit: unit}
+
+	if unit == normalizeScope(types.Ip) {
+		key.ipType = ipType(deref(d.Value))
+	}
+
+	return key
+}
+
+// ipType returns the version of an IP address or range, as the ip_type label of the usage
+// metrics, or an empty string if it can't be parsed.
+func ipType(value string) string {
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return ""
+		}
+
+		addr = prefix.Addr()
+	}
+
+	if addr.Unmap().Is4() {
+		return "ipv4"
+	}
+
+	return "ipv6"
+}
+
+func (a *activeDecisions) add(d *models.Decision, touched map[activeLabels]bool) {
+	key, ok := newStoreKey(d)
+	if !ok {
+		return
+	}
+
+	k := activeKey{key: key, id: decisionID(d)}
+
+	a.remove(k, touched)
+
+	origin := decisionOrigin(d)
+	labels := activeLabels{origin: origin, scope: deref(d.Scope), typ: deref(d.Type)}
+	usage := newUsageKey(d, origin)
+	a.decisions[k] = activeDecision{decision: d, labels: labels, usage: usage}
+	a.counts[labels]++
+	a.usage[usage]++
+	touched[labels] = true
+}
+
+func (a *activeDecisions) remove(k activeKey, touched map[activeLabels]bool) {
+	active, ok := a.decisions[k]
+	if !ok {
+		return
+	}
+
+	delete(a.decisions, k)
+
+	labels := active.labels
+
+	a.counts[labels]--
+	if a.counts[labels] == 0 {
+		delete(a.counts, labels)
+	}
+
+	a.usage[active.usage]--
+	if a.usage[active.usage] == 0 {
+		delete(a.usage, active.usage)
+	}
+
+	touched[labels] = true
+}
+
+// apply updates the counts with an update delivered by StreamBouncer.
+func (a *activeDecisions) apply(update *StreamUpdate) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	touched := make(map[activeLabels]bool)
+
+	if update.Snapshot {
+		clear(a.decisions)
+		clear(a.counts)
+		clear(a.usage)
+
+		if a.gauge != nil {
+			a.gauge.Reset()
+		}
+	} else {
+		for _, d := range update.Deleted {
+			if key, ok := newStoreKey(d); ok {
+				a.remove(activeKey{key: key, id: decisionID(d)}, touched)
+			}
+		}
+	}
+
+	for _, d := range update.New {
+		a.add(d, touched)
+	}
+
+	if a.gauge == nil {
+		return
+	}
+
+	for labels := range touched {
+		if count, ok := a.counts[labels]; ok {
+			a.gauge.WithLabelValues(labels.origin, labels.scope, labels.typ).Set(float64(count))
+		} else {
+			a.gauge.DeleteLabelValues(labels.origin, labels.scope, labels.typ)
+		}
+	}
+}
+
+// missing returns the decisions delivered before that are not in the list, which contains all
+// the active decisions. They have been deleted without the bouncer being told, or while the
+// decisions loaded from the snapshot file could not be updated.
+func (a *activeDecisions) missing(active []*models.Decision) []*models.Decision {
+	if a == nil {
+		return nil
+	}
+
+	seen := make(map[activeKey]bool, len(active))
+
+	for _, d := range active {
+		if key, ok := newStoreKey(d); ok {
+			seen[activeKey{key: key, id: decisionID(d)}] = true
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var ret []*models.Decision
+
+	for k, d := range a.decisions {
+		if !seen[k] {
+			ret = append(ret, d.decision)
+		}
+	}
+
+	return ret
+}
+
+// usageMetrics returns the active_decisions items of the usage metrics, by origin, and by IP
+// version for the decisions on IP addresses and ranges. The LAPI keeps one value per item,
+// the counts of all the remediation types are added up.
+func (a *activeDecisions) usageMetrics() []*models.MetricsDetailItem {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	items := make([]*models.MetricsDetailItem, 0, len(a.usage))
+
+	for key, count := range a.usage {
+		name := "active_decisions"
+		unit := key.unit
+		value := float64(count)
+
+		labels := models.MetricsLabels{"origin": key.origin}
+		if key.ipType != "" {
+			labels["ip_type"] = key.ipType
+		}
+
+		items = append(items, &models.MetricsDetailItem{
+			Name:   &name,
+			Unit:   &unit,
+			Value:  &value,
+			Labels: labels,
+		})
+	}
+
+	return items
+}
+
+// MetricsUpdater returns a MetricsUpdater for NewMetricsProvider that reports the active_decisions
+// usage metric, from the decisions delivered by Run, after calling next if it's not nil. next
+// must not report active_decisions itself.
+func (b *StreamBouncer) MetricsUpdater(next MetricsUpdater) MetricsUpdater {
+	return func(met *models.RemediationComponentsMetrics, interval time.Duration) {
+		if next != nil {
+			next(met, interval)
+		}
+
+		if b.active == nil {
+			return
+		}
+
+		now := time.Now().UTC().Unix()
+		window := int64(interval.Seconds())
+
+		met.Metrics = append(met.Metrics, &models.DetailedMetrics{
+			Meta: &models.MetricsMeta{
+				UtcNowTimestamp:   &now,
+				WindowSizeSeconds: &window,
+			},
+			Items: b.active.usageMetrics(),
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package csbouncer
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+func TestActiveDecisions(t *testing.T) {
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "active_decisions"}, []string{"origin", "scope", "type"})
+	active := newActiveDecisions(gauge)
+
+	list := testDecision(4, "4.4.4.4", "1h")
+	*list.Origin = "lists"
+	*list.Scenario = "firehol"
+
+	rng := testDecision(5, "10.0.0.0/8", "1h")
+	*rng.Scope = "Range"
+
+	// another remediation type from the same origin
+	captcha := testDecision(6, "7.7.7.7", "1h")
+	*captcha.Type = "captcha"
+
+	ipv6 := testDecision(7, "2001:db8::1", "1h")
+
+	active.apply(&StreamUpdate{
+		DecisionsStreamResponse: &models.DecisionsStreamResponse{
+			New: models.GetDecisionsResponse{testDecision(1, "1.2.3.4", "1h"), testDecision(2, "5.6.7.8", "1h"), list, rng},
+		},
+		Snapshot: true,
+	})
+
+	active.apply(&StreamUpdate{
+		DecisionsStreamResponse: &models.DecisionsStreamResponse{
+			// a decision received again is counted once
+			New: models.GetDecisionsResponse{testDecision(2, "5.6.7.8", "1h"), testDecision(3, "9.9.9.9", "1h"), captcha, ipv6},
+			// an unknown decision is ignored
+			Deleted: models.GetDecisionsResponse{testDecision(1, "1.2.3.4", "1h"), testDecision(42, "4.2.4.2", "1h")},
+		},
+	})
+
+	for _, tc := range []struct {
+		origin, scope string
+		want          float64
+	}{
+		{"cscli", "Ip", 3},
+		{"lists:firehol", "Ip", 1},
+		{"cscli", "Range", 1},
+	} {
+		if got := testutil.ToFloat64(gauge.WithLabelValues(tc.origin, tc.scope, "ban")); got != tc.want {
+			t.Errorf("expected %v decisions from %s on %s, got %v", tc.want, tc.origin, tc.scope, got)
+		}
+	}
+
+	items := active.usageMetrics()
+
+	values := make(map[string]float64)
+	for _, item := range items {
+		values[item.Labels["origin"]+"/"+*item.Unit+"/"+item.Labels["ip_type"]] = *item.Value
+	}
+
+	// the ban and captcha decisions are added up, by IP version
+	if len(items) != 3 || values["cscli/ip/ipv4"] != 4 || values["cscli/ip/ipv6"] != 1 || values["lists:firehol/ip/ipv4"] != 1 {
+		t.Errorf("unexpected usage metrics: %v", values)
+	}
+
+	missing := active.missing([]*models.Decision{testDecision(2, "5.6.7.8", "1h"), list, rng, captcha, ipv6})
+	if len(missing) != 1 || *missing[0].Value != "9.9.9.9" {
+		t.Errorf("expected the decision to be missing from the LAPI, got %v", missing)
+	}
+
+	active.apply(&StreamUpdate{DecisionsStreamResponse: &models.DecisionsStreamResponse{}, Snapshot: true})
+
+	if n := testutil.CollectAndCount(gauge); n != 0 {
+		t.Errorf("expected no series after an empty snapshot, got %d", n)
+	}
+}
+
+func TestStreamBouncerMetricsUpdater(t *testing.T) {
+	lapi := newFakeLAPI(t, func(url.Values) (int, string) {
+		return http.StatusOK, `{"new":[` +
+			`{"id":1,"duration":"1h","origin":"crowdsec","scenario":"ssh-bf","scope":"Ip","type":"ban","value":"1.2.3.4"},` +
+			`{"id":2,"duration":"1h","origin":"crowdsec","scenario":"ssh-bf","scope":"Ip","type":"captcha","value":"5.6.7.8"}]}`
+	})
+
+	b := &StreamBouncer{
+		APIUrl:         lapi.URL,
+		APIKey:         "key",
+		TickerInterval: "1h",
+		Store:          NewDecisionStore(),
+	}
+
+	runStreamBouncer(t, b)
+
+	waitFor(t, func() bool { return b.Store.Len() == 2 })
+
+	called := false
+
+	updater := b.MetricsUpdater(func(*models.RemediationComponentsMetrics, time.Duration) {
+		called = true
+	})
+
+	met := &models.RemediationComponentsMetrics{}
+	updater(met, 15*time.Minute)
+
+	if !called {
+		t.Error("the updater of the application should be called")
+	}
+
+	if len(met.Metrics) != 1 || *met.Metrics[0].Meta.WindowSizeSeconds != 900 {
+		t.Fatalf("expected the active decisions, got %+v", met.Metrics)
+	}
+
+	// a single item for the ban and the captcha
+	items := met.Metrics[0].Items
+	if len(items) != 1 || *items[0].Name != "active_decisions" || *items[0].Value != 2 ||
+		items[0].Labels["origin"] != "crowdsec" || items[0].Labels["ip_type"] != "ipv4" {
+		t.Fatalf("unexpected active decisions: %+v", items)
+	}
+}
@@ -0,0 +1,184 @@
+package csbouncer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
+)
+
+// maximum run time of api_key_command
+const apiKeyCommandTimeout = 30 * time.Second
+
+// hasAPIKey reports whether the configuration uses API key auth, whatever the source of the key.
+func (cfg apiClientConfig) hasAPIKey() bool {
+	return cfg.APIKey != "" || cfg.APIKeyFile != "" || cfg.APIKeyCommand != ""
+}
+
+// validateAPIKey checks that there is at most one source for the API key, and that the file can be read.
+// The command is not run, it can have side effects.
+func (cfg apiClientConfig) validateAPIKey() []error {
+	var errs []error
+
+	sources := 0
+
+	for _, source := range []string{cfg.APIKey, cfg.APIKeyFile, cfg.APIKeyCommand} {
+		if source != "" {
+			sources++
+		}
+	}
+
+	if sources > 1 {
+		errs = append(errs, errors.New("api_key, api_key_file and api_key_command are mutually exclusive"))
+	}
+
+	if cfg.APIKeyFile != "" {
+		if _, err := readAPIKeyFile(cfg.APIKeyFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// newAPIKeyTransport returns a transport that adds the API key to the requests. A key
+// read from a file is re-read when the file changes. The command is run once.
+func newAPIKeyTransport(cfg apiClientConfig, transport http.RoundTripper, logger logrus.FieldLogger) (http.RoundTripper, error) {
+	switch {
+	case cfg.APIKeyFile != "":
+		logger.Infof("Using API key from '%s'", cfg.APIKeyFile)
+
+		key, err := newAPIKeyFile(cfg.APIKeyFile, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		return &apiKeyFileTransport{key: key, Transport: transport}, nil
+	case cfg.APIKeyCommand != "":
+		logger.Info("Using API key from command")
+
+		key, err := runAPIKeyCommand(cfg.APIKeyCommand)
+		if err != nil {
+			return nil, err
+		}
+
+		return &apiclient.APIKeyTransport{APIKey: key, Transport: transport}, nil
+	default:
+		return &apiclient.APIKeyTransport{APIKey: cfg.APIKey, Transport: transport}, nil
+	}
+}
+
+func trimAPIKey(content []byte) string {
+	return strings.TrimRight(string(content), "\r\n")
+}
+
+func readAPIKeyFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read API key file '%s': %w", path, err)
+	}
+
+	key := trimAPIKey(content)
+	if key == "" {
+		return "", fmt.Errorf("API key file '%s' is empty", path)
+	}
+
+	return key, nil
+}
+
+func runAPIKeyCommand(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), apiKeyCommandTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("api_key_command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	key := trimAPIKey(out)
+	if key == "" {
+		return "", errors.New("api_key_command returned an empty key")
+	}
+
+	return key, nil
+}
+
+// apiKeyFile holds the API key read from a file, and reads it again when the file changes.
+type apiKeyFile struct {
+	watcher *fileWatcher
+	logger  logrus.FieldLogger
+
+	mu  sync.RWMutex
+	key string
+}
+
+func newAPIKeyFile(path string, logger logrus.FieldLogger) (*apiKeyFile, error) {
+	watcher := newFileWatcher(path)
+
+	key, err := readAPIKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiKeyFile{
+		watcher: watcher,
+		logger:  logger,
+		key:     key,
+	}, nil
+}
+
+// get returns the current key. If the file can't be read anymore, the previous key is kept.
+func (f *apiKeyFile) get() string {
+	if f.watcher.changed() {
+		key, err := readAPIKeyFile(f.watcher.path)
+		if err != nil {
+			f.logger.Warningf("%s, keeping the previous API key", err)
+		} else {
+			f.logger.Infof("API key file '%s' has changed, using the new key", f.watcher.path)
+
+			f.mu.Lock()
+			f.key = key
+			f.mu.Unlock()
+		}
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.key
+}
+
+// apiKeyFileTransport adds the API key from a file to the requests.
+type apiKeyFileTransport struct {
+	key *apiKeyFile
+	// Transport is the underlying transport, http.DefaultTransport if nil.
+	Transport http.RoundTripper
+}
+
+func (t *apiKeyFileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request it was given
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Api-Key", t.key.get())
+
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	return transport.RoundTrip(req)
+}
@@ -0,0 +1,131 @@
+package csbouncer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestAPIKeyFileRotation(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		keys []string
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keys = append(keys, r.Header.Get("X-Api-Key"))
+		mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	keyPath := filepath.Join(t.TempDir(), "api_key")
+
+	if err := os.WriteFile(keyPath, []byte("first\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	transport, err := newAPIKeyTransport(apiClientConfig{APIKeyFile: keyPath}, nil, logrus.StandardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher := transport.(*apiKeyFileTransport).key.watcher
+	now := time.Now()
+	watcher.now = func() time.Time { return now }
+
+	client := &http.Client{Transport: transport}
+
+	get := func() {
+		t.Helper()
+
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+	}
+
+	get()
+
+	// a different size is enough to detect the change, whatever the resolution of the mtime
+	if err := os.WriteFile(keyPath, []byte("second-key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// not checked again before the interval
+	get()
+
+	now = now.Add(defaultFileCheckInterval)
+
+	get()
+
+	// an unreadable file keeps the previous key
+	if err := os.WriteFile(keyPath, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(defaultFileCheckInterval)
+
+	get()
+
+	expected := []string{"first", "first", "second-key", "second-key"}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected keys %v, got %v", expected, keys)
+	}
+}
+
+func TestAPIKeyCommand(t *testing.T) {
+	key, err := runAPIKeyCommand(`printf 'secret\r\n'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key != "secret" {
+		t.Errorf("expected 'secret', got '%s'", key)
+	}
+
+	if _, err := runAPIKeyCommand("echo oops >&2; exit 1"); err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("expected the error output of the command, got: %v", err)
+	}
+
+	if _, err := runAPIKeyCommand("true"); err == nil {
+		t.Error("expected an error for an empty key")
+	}
+}
+
+func TestAPIKeySources(t *testing.T) {
+	cfg := apiClientConfig{
+		URL:           "http://localhost:8080/",
+		APIKey:        "secret",
+		APIKeyCommand: "echo secret",
+		APIKeyFile:    filepath.Join(t.TempDir(), "missing"),
+	}
+
+	errs := cfg.validate()
+
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", errs)
+	}
+
+	cfg = apiClientConfig{
+		URL:           "http://localhost:8080/",
+		APIKeyCommand: "echo secret",
+	}
+
+	if errs := cfg.validate(); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
@@ -0,0 +1,105 @@
+package csbouncer
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	defaultRetryInitialDelay = 10 * time.Second
+	defaultRetryMaxDelay     = 5 * time.Minute
+	defaultRetryMultiplier   = 2.0
+	defaultRetryJitter       = 0.2
+)
+
+// RetryConfig configures how StreamBouncer retries failed requests to the LAPI.
+type RetryConfig struct {
+	// delay before the first retry
+	InitialDelay string `yaml:"initial_delay"`
+	// upper bound of the delay between retries
+	MaxDelay string `yaml:"max_delay"`
+	// factor applied to the delay after each failed attempt
+	Multiplier float64 `yaml:"multiplier"`
+	// random variation of the delay, as a fraction of it (0.2 means +/- 20%).
+	// If not set, a default jitter is applied: set it to 0 to disable it.
+	Jitter *float64 `yaml:"jitter"`
+	// number of consecutive failures before giving up, 0 means retry forever
+	MaxAttempts int `yaml:"max_attempts"`
+}
+
+type backoff struct {
+	initialDelay time.Duration
+	maxDelay     time.Duration
+	multiplier   float64
+	jitter       float64
+	maxAttempts  int
+}
+
+func newBackoff(cfg RetryConfig) (*backoff, error) {
+	var err error
+
+	b := &backoff{
+		multiplier:  cfg.Multiplier,
+		jitter:      defaultRetryJitter,
+		maxAttempts: cfg.MaxAttempts,
+	}
+
+	b.initialDelay, err = parseDuration("retry.initial_delay", cfg.InitialDelay, defaultRetryInitialDelay)
+	if err != nil {
+		return nil, err
+	}
+
+	b.maxDelay, err = parseDuration("retry.max_delay", cfg.MaxDelay, defaultRetryMaxDelay)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.maxDelay < b.initialDelay {
+		return nil, errors.New("retry.max_delay must not be lower than retry.initial_delay")
+	}
+
+	switch {
+	case b.multiplier == 0:
+		b.multiplier = defaultRetryMultiplier
+	case b.multiplier < 1:
+		return nil, errors.New("retry.multiplier must be at least 1")
+	}
+
+	if cfg.Jitter != nil {
+		b.jitter = *cfg.Jitter
+	}
+
+	if b.jitter < 0 || b.jitter > 1 {
+		return nil, errors.New("retry.jitter must be between 0 and 1")
+	}
+
+	if b.maxAttempts < 0 {
+		return nil, errors.New("retry.max_attempts must not be negative")
+	}
+
+	return b, nil
+}
+
+// exhausted reports whether there have been too many consecutive failures.
+func (b *backoff) exhausted(attempts int) bool {
+	return b.maxAttempts > 0 && attempts >= b.maxAttempts
+}
+
+// delay returns how long to wait after the given number of consecutive failures (starting at 1).
+func (b *backoff) delay(attempts int) time.Duration {
+	d := float64(b.initialDelay) * math.Pow(b.multiplier, float64(max(attempts-1, 0)))
+	d = min(d, float64(b.maxDelay))
+
+	return jitter(time.Duration(d), b.jitter)
+}
+
+// jitter returns a random duration in [d - d*factor, d + d*factor].
+func jitter(d time.Duration, factor float64) time.Duration {
+	if factor <= 0 || d <= 0 {
+		return d
+	}
+
+	return time.Duration(float64(d) * (1 + factor*(2*rand.Float64()-1)))
+}
@@ -0,0 +1,61 @@
+package csbouncer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	noJitter := 0.0
+
+	b, err := newBackoff(RetryConfig{InitialDelay: "1s", MaxDelay: "10s", Multiplier: 3, Jitter: &noJitter})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []time.Duration{time.Second, 3 * time.Second, 9 * time.Second, 10 * time.Second, 10 * time.Second}
+
+	for i, want := range expected {
+		if got := b.delay(i + 1); got != want {
+			t.Errorf("attempt %d: expected %s, got %s", i+1, want, got)
+		}
+	}
+
+	if b.exhausted(1000) {
+		t.Error("max_attempts=0 should retry forever")
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b, err := newBackoff(RetryConfig{InitialDelay: "10s", MaxAttempts: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 100 {
+		d := b.delay(1)
+		if d < 8*time.Second || d > 12*time.Second {
+			t.Fatalf("delay %s out of the default jitter bounds", d)
+		}
+	}
+
+	if b.exhausted(2) || !b.exhausted(3) {
+		t.Error("unexpected max_attempts behavior")
+	}
+}
+
+func TestBackoffConfig(t *testing.T) {
+	tooMuch := 1.5
+
+	for _, cfg := range []RetryConfig{
+		{InitialDelay: "1m", MaxDelay: "1s"},
+		{Multiplier: 0.5},
+		{Jitter: &tooMuch},
+		{MaxAttempts: -1},
+		{InitialDelay: "soon"},
+	} {
+		if _, err := newBackoff(cfg); err == nil {
+			t.Errorf("expected an error for %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package csbouncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerFailureThreshold = 5
+	defaultBreakerOpenTimeout      = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned when the circuit breaker does not let a request reach the LAPI.
+var ErrCircuitOpen = errors.New("circuit breaker is open, LAPI not called")
+
+// CircuitBreakerConfig configures the circuit breaker in front of LiveBouncer.Get.
+type CircuitBreakerConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// number of consecutive failures before the circuit opens
+	FailureThreshold int `yaml:"failure_threshold"`
+	// how long the circuit stays open before a probe request is allowed
+	OpenTimeout string `yaml:"open_timeout"`
+}
+
+type BreakerState int
+
+const (
+	// BreakerClosed lets all the requests through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects all the requests until the open timeout has elapsed.
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe request through, to decide whether to close the circuit again.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+type circuitBreaker struct {
+	mu          sync.Mutex
+	state       BreakerState
+	failures    int
+	threshold   int
+	openTimeout time.Duration
+	openedAt    time.Time
+	probing     bool
+	metrics     *bouncerMetrics
+
+	// overridden by tests
+	now func() time.Time
+}
+
+func newCircuitBreaker(cfg CircuitBreakerConfig, metrics *bouncerMetrics) (*circuitBreaker, error) {
+	if cfg.FailureThreshold < 0 {
+		return nil, errors.New("circuit_breaker.failure_threshold must not be negative")
+	}
+
+	threshold := cfg.FailureThreshold
+	if threshold == 0 {
+		threshold = defaultBreakerFailureThreshold
+	}
+
+	openTimeout, err := parseDuration("circuit_breaker.open_timeout", cfg.OpenTimeout, defaultBreakerOpenTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &circuitBreaker{
+		state:       BreakerClosed,
+		threshold:   threshold,
+		openTimeout: openTimeout,
+		metrics:     metrics,
+		now:         time.Now,
+	}, nil
+}
+
+// setState must be called with the lock held.
+func (cb *circuitBreaker) setState(state BreakerState) {
+	if cb.state == state {
+		return
+	}
+
+	cb.state = state
+
+	cb.metrics.observeBreakerTransition(state)
+}
+
+func (cb *circuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.state
+}
+
+// allow reports whether a request can be sent. When the open timeout has
+// elapsed, the circuit becomes half-open and a single probe is allowed.
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case BreakerOpen:
+		if cb.now().Sub(cb.openedAt) < cb.openTimeout {
+			return false
+		}
+
+		cb.setState(BreakerHalfOpen)
+	case BreakerHalfOpen:
+		if cb.probing {
+			return false
+		}
+	case BreakerClosed:
+		return true
+	}
+
+	cb.probing = true
+
+	return true
+}
+
+// record updates the state of the circuit with the result of a request that was allowed.
+func (cb *circuitBreaker) record(err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probing = false
+
+	switch {
+	case err == nil:
+		cb.failures = 0
+		cb.setState(BreakerClosed)
+	case errors.Is(err, context.Canceled):
+		// the request was abandoned, it tells nothing about the LAPI
+	default:
+		cb.failures++
+
+		if cb.state == BreakerHalfOpen || cb.failures >= cb.threshold {
+			cb.openedAt = cb.now()
+			cb.setState(BreakerOpen)
+		}
+	}
+}
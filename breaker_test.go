@@ -0,0 +1,241 @@
+package csbouncer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb, err := newCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 2, OpenTimeout: "10s"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	cb.now = func() time.Time { return now }
+
+	failure := errors.New("connection refused")
+
+	for range 2 {
+		if !cb.allow() {
+			t.Fatal("a closed circuit should allow requests")
+		}
+
+		cb.record(failure)
+	}
+
+	if cb.State() != BreakerOpen {
+		t.Fatalf("expected open circuit, got %s", cb.State())
+	}
+
+	if cb.allow() {
+		t.Fatal("an open circuit should reject requests")
+	}
+
+	now = now.Add(10 * time.Second)
+
+	if !cb.allow() {
+		t.Fatal("a probe should be allowed after the open timeout")
+	}
+
+	if cb.State() != BreakerHalfOpen {
+		t.Fatalf("expected half-open circuit, got %s", cb.State())
+	}
+
+	if cb.allow() {
+		t.Fatal("only one probe at a time")
+	}
+
+	cb.record(failure)
+
+	if cb.State() != BreakerOpen {
+		t.Fatalf("a failed probe should open the circuit, got %s", cb.State())
+	}
+
+	now = now.Add(10 * time.Second)
+
+	if !cb.allow() {
+		t.Fatal("a probe should be allowed after the open timeout")
+	}
+
+	cb.record(nil)
+
+	if cb.State() != BreakerClosed {
+		t.Fatalf("a successful probe should close the circuit, got %s", cb.State())
+	}
+}
+
+func newFailingLAPI(t *testing.T, fail *atomic.Bool, calls *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`[{"duration":"1s","origin":"cscli","scenario":"manual","scope":"Ip","type":"ban","value":"1.2.3.4"}]`))
+	}))
+
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestLiveBouncerFailurePolicy(t *testing.T) {
+	tests := []struct {
+		policy       string
+		expectErr    bool
+		expectedType string
+	}{
+		{"", true, ""},
+		{FailurePolicyOpen, false, ""},
+		{FailurePolicyClosed, false, "captcha"},
+		{FailurePolicyCache, false, "ban"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.policy, func(t *testing.T) {
+			var (
+				fail  atomic.Bool
+				calls atomic.Int32
+			)
+
+			srv := newFailingLAPI(t, &fail, &calls)
+
+			b := &LiveBouncer{
+				APIKey:             "key",
+				APIUrl:             srv.URL,
+				FailurePolicy:      tc.policy,
+				FailureRemediation: "captcha",
+				Cache:              CacheConfig{Enabled: true, MaxTTL: "1ms"},
+				CircuitBreaker:     CircuitBreakerConfig{Enabled: true, FailureThreshold: 1, OpenTimeout: "1h"},
+			}
+
+			if err := b.Init(); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := context.Background()
+
+			if _, err := b.Get(ctx, "1.2.3.4"); err != nil {
+				t.Fatal(err)
+			}
+
+			time.Sleep(2 * time.Millisecond)
+			fail.Store(true)
+
+			// the first failure opens the circuit, the second call doesn't reach the LAPI
+			for range 2 {
+				decisions, err := b.Get(ctx, "1.2.3.4")
+
+				switch {
+				case tc.expectErr:
+					if err == nil {
+						t.Fatal("expected an error")
+					}
+				case err != nil:
+					t.Fatal(err)
+				case tc.expectedType == "" && len(*decisions) != 0:
+					t.Fatalf("expected no decision, got %d", len(*decisions))
+				case tc.expectedType != "" && (len(*decisions) != 1 || *(*decisions)[0].Type != tc.expectedType):
+					t.Fatalf("expected a %s decision", tc.expectedType)
+				}
+			}
+
+			if calls.Load() != 2 {
+				t.Errorf("expected 2 calls to the LAPI, got %d", calls.Load())
+			}
+
+			if b.BreakerState() != BreakerOpen {
+				t.Errorf("expected open circuit, got %s", b.BreakerState())
+			}
+		})
+	}
+}
+
+func TestBreakerMetrics(t *testing.T) {
+	var (
+		fail  atomic.Bool
+		calls atomic.Int32
+	)
+
+	srv := newFailingLAPI(t, &fail, &calls)
+	fail.Store(true)
+
+	b := &LiveBouncer{
+		APIKey:            "key",
+		APIUrl:            srv.URL,
+		CircuitBreaker:    CircuitBreakerConfig{Enabled: true, FailureThreshold: 1, OpenTimeout: "1h"},
+		MetricsRegisterer: prometheus.NewPedanticRegistry(),
+	}
+
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.Get(context.Background(), "1.2.3.4"); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if v := testutil.ToFloat64(b.metrics.breakerState); v != float64(BreakerOpen) {
+		t.Fatalf("expected an open circuit, got %v", v)
+	}
+
+	if v := testutil.ToFloat64(b.metrics.breakerTransitions.WithLabelValues("open")); v != 1 {
+		t.Fatalf("expected 1 transition, got %v", v)
+	}
+
+	// the new circuit breaker is reported
+	config := "api_url: " + srv.URL + "\napi_key: key\ncircuit_breaker:\n  enabled: true\n  open_timeout: 2h\n"
+
+	if err := b.Reload(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := testutil.ToFloat64(b.metrics.breakerState); v != float64(BreakerClosed) {
+		t.Fatalf("expected a closed circuit after reload, got %v", v)
+	}
+}
+
+func TestFailureLog(t *testing.T) {
+	hooks := logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	t.Cleanup(func() { logrus.StandardLogger().ReplaceHooks(hooks) })
+
+	hook := logrustest.NewGlobal()
+
+	now := time.Now()
+
+	l := &failureLog{now: func() time.Time { return now }}
+
+	for range 5 {
+		l.warnf("LAPI unavailable")
+	}
+
+	now = now.Add(failureLogInterval)
+
+	l.warnf("LAPI unavailable")
+
+	entries := hook.AllEntries()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 warnings, got %d", len(entries))
+	}
+
+	if entries[1].Message != "LAPI unavailable (4 similar messages suppressed)" {
+		t.Errorf("unexpected message: %s", entries[1].Message)
+	}
+}
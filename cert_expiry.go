@@ -0,0 +1,203 @@
+package csbouncer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// default thresholds of the warnings before a certificate expires
+var defaultCertExpiryWarnings = []time.Duration{30 * 24 * time.Hour, 7 * 24 * time.Hour, 24 * time.Hour}
+
+// parseCertExpiryWarnings parses the comma-separated thresholds of the warnings, from the longest to the shortest.
+func parseCertExpiryWarnings(value string) ([]time.Duration, error) {
+	if value == "" {
+		return defaultCertExpiryWarnings, nil
+	}
+
+	var thresholds []time.Duration
+
+	for s := range strings.SplitSeq(value, ",") {
+		s = strings.TrimSpace(s)
+
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse cert_expiry_warnings '%s': %w", s, err)
+		}
+
+		if d <= 0 {
+			return nil, errors.New("cert_expiry_warnings must be positive")
+		}
+
+		thresholds = append(thresholds, d)
+	}
+
+	slices.Sort(thresholds)
+	slices.Reverse(thresholds)
+
+	return thresholds, nil
+}
+
+// readCertificates returns the certificates of a PEM bundle.
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+
+	for {
+		var block *pem.Block
+
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+type certExpiry struct {
+	notAfter time.Time
+	// number of thresholds already crossed, to warn only once for each
+	warned int
+}
+
+// certExpiryMonitor keeps track of the expiry of the certificates in use, to update the
+// metric and log a warning each time a threshold is crossed.
+type certExpiryMonitor struct {
+	thresholds []time.Duration
+	logger     logrus.FieldLogger
+	metrics    *bouncerMetrics
+
+	mu    sync.Mutex
+	certs map[[2]string]*certExpiry
+
+	// overridden by tests
+	now func() time.Time
+}
+
+func newCertExpiryMonitor(thresholds []time.Duration, metrics *bouncerMetrics, logger logrus.FieldLogger) *certExpiryMonitor {
+	return &certExpiryMonitor{
+		thresholds: thresholds,
+		logger:     logger,
+		metrics:    metrics,
+		certs:      make(map[[2]string]*certExpiry),
+		now:        time.Now,
+	}
+}
+
+// observe records the expiry of a certificate that has been loaded. kind is "client" or "ca".
+func (m *certExpiryMonitor) observe(kind string, path string, certs []*x509.Certificate) {
+	if len(certs) == 0 {
+		return
+	}
+
+	notAfter := certs[0].NotAfter
+
+	for _, cert := range certs[1:] {
+		if cert.NotAfter.Before(notAfter) {
+			notAfter = cert.NotAfter
+		}
+	}
+
+	m.metrics.observeCertExpiry(kind, path, notAfter)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := [2]string{kind, path}
+
+	if c, ok := m.certs[key]; ok && c.notAfter.Equal(notAfter) {
+		return
+	}
+
+	m.certs[key] = &certExpiry{notAfter: notAfter}
+}
+
+// observeKeyPair records the expiry of a client certificate.
+func (m *certExpiryMonitor) observeKeyPair(path string, certificate *tls.Certificate) {
+	leaf := certificate.Leaf
+
+	if leaf == nil && len(certificate.Certificate) > 0 {
+		var err error
+
+		leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			return
+		}
+	}
+
+	if leaf != nil {
+		m.observe("client", path, []*x509.Certificate{leaf})
+	}
+}
+
+// observeCA records the expiry of a CA bundle.
+func (m *certExpiryMonitor) observeCA(path string) {
+	certs, err := readCertificates(path)
+	if err != nil {
+		m.logger.Warningf("unable to check the expiry of CA certificates '%s': %s", path, err)
+
+		return
+	}
+
+	m.observe("ca", path, certs)
+}
+
+// check logs a warning for the certificates that have crossed a new threshold.
+func (m *certExpiryMonitor) check() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+
+	for key, c := range m.certs {
+		kind, path := key[0], key[1]
+		remaining := c.notAfter.Sub(now)
+
+		if remaining <= 0 {
+			if c.warned <= len(m.thresholds) {
+				m.logger.Errorf("%s certificate '%s' has expired on %s", kind, path, c.notAfter.Format(time.RFC3339))
+				c.warned = len(m.thresholds) + 1
+			}
+
+			continue
+		}
+
+		crossed := 0
+
+		for _, threshold := range m.thresholds {
+			if remaining <= threshold {
+				crossed++
+			}
+		}
+
+		if crossed > c.warned {
+			m.logger.Warningf("%s certificate '%s' expires in %s, on %s", kind, path, remaining.Round(time.Minute), c.notAfter.Format(time.RFC3339))
+			c.warned = crossed
+		}
+	}
+}
@@ -1,85 +1,323 @@
 package csbouncer
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
 )
 
-func getAPIClient(urlstr string, userAgent string, apiKey string, caPath string, certPath string, keyPath string, skipVerify *bool, logger logrus.FieldLogger) (*apiclient.ApiClient, error) {
-	var client *http.Client
+// apiClientConfig contains the settings used to build the API client. It is
+// comparable, to detect when the client must be rebuilt on reload.
+type apiClientConfig struct {
+	URL                string
+	URLs               string // space-separated, instead of URL
+	LoadBalancing      string
+	UserAgent          string
+	APIKey             string
+	APIKeyFile         string
+	APIKeyCommand      string
+	CAPath             string
+	CertPath           string
+	KeyPath            string
+	InsecureSkipVerify bool
+	// lists are comma-separated, to keep the struct comparable
+	CertExpiryWarnings string
+	TLSMinVersion      string
+	TLSMaxVersion      string
+	TLSCipherSuites    string
+	TLSServerName      string
+	TLSPinnedSHA256    string
+	ProxyURL           string
+	NoProxy            string
+	Timeouts           TimeoutConfig
+}
+
+// transportOptions are the HTTP client and transport provided by the application, and the
+// collectors of the bouncer.
+type transportOptions struct {
+	client    *http.Client
+	transport http.RoundTripper
+	wrap      func(http.RoundTripper) http.RoundTripper
+	// counts the requests of each endpoint, if not nil
+	metrics *bouncerMetrics
+}
 
-	if apiKey == "" && certPath == "" && keyPath == "" {
-		return nil, errors.New("no API key nor certificate provided")
+// base returns the transport to build upon, nil for the default one.
+func (o transportOptions) base() http.RoundTripper {
+	if o.transport != nil {
+		return o.transport
 	}
 
-	if apiKey != "" && (certPath != "" || keyPath != "") {
-		return nil, errors.New("cannot use both API key and certificate auth")
+	if o.client != nil {
+		return o.client.Transport
 	}
 
-	insecureSkipVerify := false
+	return nil
+}
 
-	apiURL, err := url.Parse(urlstr)
-	if err != nil {
-		return nil, fmt.Errorf("local API Url '%s': %w", urlstr, err)
+// wrapTransport applies the hook of the application, if any.
+func (o transportOptions) wrapTransport(transport http.RoundTripper) http.RoundTripper {
+	if o.wrap == nil {
+		return transport
+	}
+
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	return o.wrap(transport)
+}
+
+// httpClient returns a copy of the client of the application, or a new one, using the given transport.
+func (o transportOptions) httpClient(transport http.RoundTripper) *http.Client {
+	client := &http.Client{}
+
+	if o.client != nil {
+		c := *o.client
+		client = &c
 	}
 
-	if skipVerify != nil && *skipVerify {
-		insecureSkipVerify = true
+	client.Transport = transport
+
+	return client
+}
+
+// getAPIClient builds the API client. Its transport is an endpointSet, that sends the
+// requests to one of the LAPI urls, with the authentication layer on top of it.
+func getAPIClient(cfg apiClientConfig, opts transportOptions, logger logrus.FieldLogger) (*apiclient.ApiClient, *endpointSet, error) {
+	var transport http.RoundTripper
+
+	if !cfg.hasAPIKey() && cfg.CertPath == "" && cfg.KeyPath == "" {
+		return nil, nil, errors.New("no API key nor certificate provided")
+	}
+
+	if cfg.hasAPIKey() && (cfg.CertPath != "" || cfg.KeyPath != "") {
+		return nil, nil, errors.New("cannot use both API key and certificate auth")
 	}
 
-	caCertPool, err := getCertPool(caPath, logger)
+	files, err := newTLSFiles(cfg, opts.metrics, logger)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	if apiKey != "" {
-		var transport *apiclient.APIKeyTransport
+	timeouts, err := cfg.Timeouts.settings()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	base := opts.baseTransport(cfg, timeouts, logger)
 
+	if cfg.hasAPIKey() {
 		logger.Info("Using API key auth")
+	} else {
+		logger.Infof("Using cert auth with cert '%s' and key '%s'", cfg.CertPath, cfg.KeyPath)
+	}
+
+	urls := cfg.urls()
+	endpoints := make([]*endpoint, 0, len(urls))
 
-		if apiURL.Scheme == "https" {
-			transport = &apiclient.APIKeyTransport{
-				APIKey: apiKey,
-				Transport: &http.Transport{
-					TLSClientConfig: &tls.Config{
-						RootCAs:            caCertPool,
-						InsecureSkipVerify: insecureSkipVerify,
-					},
-				},
-			}
-		} else {
-			transport = &apiclient.APIKeyTransport{
-				APIKey: apiKey,
-			}
+	for _, rawURL := range urls {
+		e, err := newEndpoint(cfg, rawURL, base, files, opts, timeouts, logger)
+		if err != nil {
+			return nil, nil, err
 		}
 
-		client = transport.Client()
+		endpoints = append(endpoints, e)
 	}
 
-	if certPath != "" && keyPath != "" {
-		logger.Infof("Using cert auth with cert '%s' and key '%s'", certPath, keyPath)
+	set := newEndpointSet(endpoints, cfg.LoadBalancing == LoadBalancingRoundRobin, logger)
+	transport = set
+
+	if cfg.hasAPIKey() {
+		transport, err = newAPIKeyTransport(cfg, set, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	client := opts.httpClient(transport)
+
+	// keep the timeout of the client provided by the application, unless it's in the configuration
+	if client.Timeout == 0 || cfg.Timeouts.Request != "" {
+		client.Timeout = timeouts.request
+	}
+
+	apiClient, err := apiclient.NewDefaultClient(set.base, "v1", cfg.UserAgent, client)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return apiClient, set, nil
+}
+
+// newEndpoint builds the transport to a LAPI url, without the authentication layer.
+func newEndpoint(cfg apiClientConfig, rawURL string, base http.RoundTripper, files *tlsFiles, opts transportOptions, timeouts timeoutSettings, logger logrus.FieldLogger) (*endpoint, error) {
+	apiURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("local API Url '%s': %w", rawURL, err)
+	}
+
+	transport := base
+
+	switch {
+	case apiURL.Scheme == "unix":
+		if !cfg.hasAPIKey() {
+			return nil, errors.New("certificate auth is not possible over a unix socket")
+		}
+
+		socket := strings.TrimSuffix(apiURL.Path, "/")
+
+		logger.Infof("Using unix socket '%s'", socket)
+
+		transport, err = unixSocketTransport(base, socket, timeouts)
+		if err != nil {
+			return nil, err
+		}
 
-		certificate, err := tls.LoadX509KeyPair(certPath, keyPath)
+		// the host is not used but is required in the requests
+		apiURL = &url.URL{Scheme: "http", Host: "localhost", Path: "/"}
+	case apiURL.Scheme == "https" || !cfg.hasAPIKey():
+		transport, err = files.transport(base, apiURL.Hostname(), cfg.InsecureSkipVerify)
 		if err != nil {
-			return nil, fmt.Errorf("unable to load certificate '%s' and key '%s': %w", certPath, keyPath, err)
+			return nil, err
 		}
+	}
+
+	return &endpoint{
+		name:      rawURL,
+		base:      apiURL,
+		transport: opts.metrics.instrument(rawURL, opts.wrapTransport(transport)),
+	}, nil
+}
+
+// urls returns the LAPI urls, in the order of priority.
+func (cfg apiClientConfig) urls() []string {
+	if cfg.URLs != "" {
+		return strings.Fields(cfg.URLs)
+	}
+
+	return []string{cfg.URL}
+}
+
+// unixSocketTransport returns a transport that sends all the requests to a unix socket.
+// The base transport must be an *http.Transport, to set its dialer.
+func unixSocketTransport(base http.RoundTripper, socket string, timeouts timeoutSettings) (http.RoundTripper, error) {
+	var transport *http.Transport
+
+	switch t := base.(type) {
+	case nil:
+		transport = &http.Transport{}
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		// the requests would go to localhost over TCP
+		return nil, fmt.Errorf("a unix socket requires an *http.Transport, got %T", base)
+	}
+
+	dialer := timeouts.dialer()
+
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", socket)
+	}
+
+	return transport, nil
+}
+
+func (cfg apiClientConfig) validateURL(rawURL string) []error {
+	var errs []error
+
+	apiURL, err := url.Parse(rawURL)
+	if err != nil {
+		return []error{fmt.Errorf("invalid LAPI url '%s': %w", rawURL, err)}
+	}
+
+	switch apiURL.Scheme {
+	case "http", "https":
+	case "unix":
+		if strings.TrimSuffix(apiURL.Path, "/") == "" {
+			errs = append(errs, fmt.Errorf("invalid LAPI url '%s': no socket path", rawURL))
+		}
+
+		if cfg.CertPath != "" || cfg.KeyPath != "" {
+			errs = append(errs, errors.New("certificate auth is not possible over a unix socket"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid LAPI url '%s': scheme must be http, https or unix", rawURL))
+	}
+
+	return errs
+}
+
+// validate returns all the problems found in the connection settings.
+func (cfg apiClientConfig) validate() []error {
+	var errs []error
+
+	switch {
+	case cfg.URL == "" && cfg.URLs == "":
+		errs = append(errs, errors.New("config does not contain LAPI url"))
+	case cfg.URL != "" && cfg.URLs != "":
+		errs = append(errs, errors.New("api_url and api_urls are mutually exclusive"))
+	default:
+		for _, rawURL := range cfg.urls() {
+			errs = append(errs, cfg.validateURL(rawURL)...)
+		}
+	}
+
+	switch cfg.LoadBalancing {
+	case "", LoadBalancingFailover, LoadBalancingRoundRobin:
+	default:
+		errs = append(errs, fmt.Errorf("unknown load_balancing '%s'", cfg.LoadBalancing))
+	}
+
+	switch {
+	case !cfg.hasAPIKey() && cfg.CertPath == "" && cfg.KeyPath == "":
+		errs = append(errs, errors.New("config does not contain LAPI key or certificate"))
+	case cfg.hasAPIKey() && (cfg.CertPath != "" || cfg.KeyPath != ""):
+		errs = append(errs, errors.New("cannot use both API key and certificate auth"))
+	case !cfg.hasAPIKey() && (cfg.CertPath == "" || cfg.KeyPath == ""):
+		errs = append(errs, errors.New("cert_path and key_path must be set together"))
+	}
+
+	errs = append(errs, cfg.validateAPIKey()...)
+
+	if _, err := parseCertExpiryWarnings(cfg.CertExpiryWarnings); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := cfg.tlsSettings(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := cfg.validateProxy(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := cfg.Timeouts.settings(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if cfg.CertPath != "" && cfg.KeyPath != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.CertPath, cfg.KeyPath); err != nil {
+			errs = append(errs, fmt.Errorf("unable to load certificate '%s' and key '%s': %w", cfg.CertPath, cfg.KeyPath, err))
+		}
+	}
 
-		client = &http.Client{}
-		client.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs:            caCertPool,
-				Certificates:       []tls.Certificate{certificate},
-				InsecureSkipVerify: insecureSkipVerify,
-			},
+	if cfg.CAPath != "" {
+		if _, err := os.ReadFile(cfg.CAPath); err != nil {
+			errs = append(errs, fmt.Errorf("unable to load CA certificate '%s': %w", cfg.CAPath, err))
 		}
 	}
 
-	return apiclient.NewDefaultClient(apiURL, "v1", userAgent, client)
+	return errs
 }
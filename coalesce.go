@@ -0,0 +1,86 @@
+package csbouncer
+
+import (
+	"context"
+	"sync"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+// lookupGroup collapses concurrent lookups for the same key into a single call.
+//
+// The call runs with its own context, which is only canceled when all the
+// callers waiting for it have given up: a caller whose context is canceled
+// returns immediately without affecting the others.
+//
+// The zero value is ready to use.
+type lookupGroup struct {
+	mu    sync.Mutex
+	calls map[string]*lookupCall
+}
+
+type lookupCall struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	val     *models.GetDecisionsResponse
+	err     error
+}
+
+func (g *lookupGroup) do(ctx context.Context, key string, fn func(context.Context) (*models.GetDecisionsResponse, error)) (*models.GetDecisionsResponse, error) {
+	g.mu.Lock()
+
+	if g.calls == nil {
+		g.calls = make(map[string]*lookupCall)
+	}
+
+	c, ok := g.calls[key]
+	if !ok {
+		// keep the values of the context (logging, tracing...) but not its cancellation
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+
+		c = &lookupCall{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		g.calls[key] = c
+
+		go func() {
+			defer cancel()
+
+			c.val, c.err = fn(callCtx)
+
+			g.mu.Lock()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+			g.mu.Unlock()
+
+			close(c.done)
+		}()
+	}
+
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		g.mu.Lock()
+
+		c.waiters--
+		if c.waiters == 0 {
+			// nobody is waiting anymore: abort the request, and don't let new callers join it
+			c.cancel()
+
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+		}
+
+		g.mu.Unlock()
+
+		return nil, ctx.Err()
+	}
+}
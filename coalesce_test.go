@@ -0,0 +1,104 @@
+package csbouncer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+func TestLookupGroupCoalesce(t *testing.T) {
+	var (
+		g       lookupGroup
+		calls   atomic.Int32
+		release = make(chan struct{})
+		wg      sync.WaitGroup
+	)
+
+	expected := &models.GetDecisionsResponse{}
+
+	fn := func(_ context.Context) (*models.GetDecisionsResponse, error) {
+		calls.Add(1)
+		<-release
+
+		return expected, nil
+	}
+
+	canceledCtx, cancel := context.WithCancel(context.Background())
+
+	for i := range 10 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			ctx := context.Background()
+			if i == 0 {
+				ctx = canceledCtx
+			}
+
+			got, err := g.do(ctx, "1.2.3.4", fn)
+
+			switch {
+			case i == 0 && !errors.Is(err, context.Canceled):
+				t.Errorf("expected the canceled caller to return context.Canceled, got %v", err)
+			case i != 0 && (err != nil || got != expected):
+				t.Errorf("unexpected result: %v, %v", got, err)
+			}
+		}()
+	}
+
+	waiters := func() int {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		if c, ok := g.calls["1.2.3.4"]; ok {
+			return c.waiters
+		}
+
+		return 0
+	}
+
+	// wait for all the callers to join the call, then cancel one of them
+	waitFor(t, func() bool { return waiters() == 10 })
+	cancel()
+	waitFor(t, func() bool { return waiters() == 9 })
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("expected a single call, got %d", got)
+	}
+}
+
+func TestLookupGroupCancelAll(t *testing.T) {
+	var g lookupGroup
+
+	ctx, cancel := context.WithCancel(context.Background())
+	aborted := make(chan struct{})
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := g.do(ctx, "1.2.3.4", func(callCtx context.Context) (*models.GetDecisionsResponse, error) {
+		<-callCtx.Done()
+		close(aborted)
+
+		return nil, callCtx.Err()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("the call should be canceled when no caller is waiting")
+	}
+}
@@ -0,0 +1,278 @@
+package csbouncer
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+// bouncerMetrics are the Prometheus collectors of a bouncer. Each bouncer has its own, with
+// the constant labels of its configuration, so that several bouncers in a process can be told apart.
+type bouncerMetrics struct {
+	requests   *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	certExpiry *prometheus.GaugeVec
+	// decisions received by StreamBouncer, nil for LiveBouncer
+	decisions *prometheus.CounterVec
+	lastPull  prometheus.Gauge
+	active    *prometheus.GaugeVec
+	// circuit breaker of LiveBouncer, nil for StreamBouncer
+	breakerState       prometheus.GaugeFunc
+	breakerTransitions *prometheus.CounterVec
+}
+
+// newBouncerMetrics creates the collectors and registers them, if reg is not nil. The ones
+// of the previous Init of the bouncer, if any, are reused; it's an error if another bouncer
+// has registered them with the same labels. The decision stream collectors are created if
+// stream is true, the circuit breaker collectors if breakerState is not nil.
+func newBouncerMetrics(labels prometheus.Labels, reg prometheus.Registerer, previous *bouncerMetrics, stream bool, breakerState func() BreakerState) (*bouncerMetrics, error) {
+	m := &bouncerMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "lapi_client_requests_total",
+			Help:        "The total number of requests to CrowdSec LAPI, by status code ('error' if there was no response)",
+			ConstLabels: labels,
+		}, []string{"lapi_url", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "lapi_client_request_duration_seconds",
+			Help:        "Duration of the requests to CrowdSec LAPI until the response headers, by API endpoint",
+			ConstLabels: labels,
+			Buckets:     prometheus.DefBuckets,
+		}, []string{"lapi_url", "endpoint"}),
+		certExpiry: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "lapi_certificate_expiry_timestamp_seconds",
+			Help:        "Expiry date of the certificates used to connect to CrowdSec LAPI, as a unix timestamp. For a CA bundle, the first certificate to expire.",
+			ConstLabels: labels,
+		}, []string{"type", "path"}),
+	}
+
+	if stream {
+		m.decisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "lapi_stream_decisions_total",
+			Help:        "The total number of new and deleted decisions received from CrowdSec LAPI, by origin and type",
+			ConstLabels: labels,
+		}, []string{"action", "origin", "type"})
+		m.lastPull = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "lapi_stream_last_pull_timestamp_seconds",
+			Help:        "Time of the last successful pull of the decisions from CrowdSec LAPI, as a unix timestamp",
+			ConstLabels: labels,
+		})
+		m.active = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "active_decisions",
+			Help:        "The number of decisions enforced by the bouncer, by origin, scope and type",
+			ConstLabels: labels,
+		}, []string{"origin", "scope", "type"})
+	}
+
+	if breakerState != nil {
+		m.breakerState = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "lapi_circuit_breaker_state",
+			Help:        "State of the circuit breaker in front of CrowdSec LAPI (0: closed, 1: open, 2: half-open)",
+			ConstLabels: labels,
+		}, func() float64 { return float64(breakerState()) })
+		m.breakerTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "lapi_circuit_breaker_transitions_total",
+			Help:        "The total number of state changes of the circuit breaker in front of CrowdSec LAPI",
+			ConstLabels: labels,
+		}, []string{"state"})
+	}
+
+	if reg == nil {
+		return m, nil
+	}
+
+	if previous == nil {
+		previous = &bouncerMetrics{}
+	}
+
+	if err := m.registerAll(reg, previous); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// registerAll registers the collectors that have been created, reusing the ones of previous.
+func (m *bouncerMetrics) registerAll(reg prometheus.Registerer, previous *bouncerMetrics) error {
+	var err error
+
+	if m.requests, err = register(reg, m.requests, previous.requests); err != nil {
+		return err
+	}
+
+	if m.duration, err = register(reg, m.duration, previous.duration); err != nil {
+		return err
+	}
+
+	if m.certExpiry, err = register(reg, m.certExpiry, previous.certExpiry); err != nil {
+		return err
+	}
+
+	if m.decisions != nil {
+		if m.decisions, err = register(reg, m.decisions, previous.decisions); err != nil {
+			return err
+		}
+
+		if m.lastPull, err = register(reg, m.lastPull, previous.lastPull); err != nil {
+			return err
+		}
+
+		if m.active, err = register(reg, m.active, previous.active); err != nil {
+			return err
+		}
+	}
+
+	if m.breakerState != nil {
+		if m.breakerState, err = register(reg, m.breakerState, previous.breakerState); err != nil {
+			return err
+		}
+
+		if m.breakerTransitions, err = register(reg, m.breakerTransitions, previous.breakerTransitions); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// register registers a collector, or returns the one that is already registered if it's
+// own, the same collector of the previous Init.
+func register[T prometheus.Collector](reg prometheus.Registerer, c T, own T) (T, error) {
+	err := reg.Register(c)
+	if err == nil {
+		return c, nil
+	}
+
+	var already prometheus.AlreadyRegisteredError
+	if errors.As(err, &already) {
+		if existing, ok := already.ExistingCollector.(T); ok && prometheus.Collector(existing) == prometheus.Collector(own) {
+			return existing, nil
+		}
+
+		return c, errors.New("the collectors are already registered by another bouncer, set distinct MetricsLabels")
+	}
+
+	return c, err
+}
+
+func (m *bouncerMetrics) collectors() []prometheus.Collector {
+	collectors := []prometheus.Collector{m.requests, m.duration, m.certExpiry}
+
+	if m.decisions != nil {
+		collectors = append(collectors, m.decisions, m.lastPull, m.active)
+	}
+
+	if m.breakerState != nil {
+		collectors = append(collectors, m.breakerState, m.breakerTransitions)
+	}
+
+	return collectors
+}
+
+func (m *bouncerMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+func (m *bouncerMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// observePull records a successful pull of the decision stream.
+func (m *bouncerMetrics) observePull(data *models.DecisionsStreamResponse, now time.Time) {
+	if m == nil {
+		return
+	}
+
+	m.lastPull.Set(float64(now.Unix()))
+
+	if data == nil {
+		return
+	}
+
+	for _, d := range data.New {
+		m.decisions.WithLabelValues("new", deref(d.Origin), deref(d.Type)).Inc()
+	}
+
+	for _, d := range data.Deleted {
+		m.decisions.WithLabelValues("deleted", deref(d.Origin), deref(d.Type)).Inc()
+	}
+}
+
+// observeBreakerTransition counts a state change of the circuit breaker.
+func (m *bouncerMetrics) observeBreakerTransition(state BreakerState) {
+	if m == nil || m.breakerTransitions == nil {
+		return
+	}
+
+	m.breakerTransitions.WithLabelValues(state.String()).Inc()
+}
+
+// observeCertExpiry records the expiry of a certificate. kind is "client" or "ca".
+func (m *bouncerMetrics) observeCertExpiry(kind string, path string, notAfter time.Time) {
+	if m == nil {
+		return
+	}
+
+	m.certExpiry.WithLabelValues(kind, path).Set(float64(notAfter.Unix()))
+}
+
+// apiEndpoint returns the name of the API endpoint of a request, for the metrics.
+func apiEndpoint(path string) string {
+	switch {
+	case strings.HasSuffix(path, "/decisions/stream"):
+		return "decisions_stream"
+	case strings.HasSuffix(path, "/decisions"):
+		return "decisions_list"
+	case strings.HasSuffix(path, "/usage-metrics"):
+		return "usage_metrics"
+	default:
+		return "other"
+	}
+}
+
+// instrument returns a transport that counts and times the requests sent to an endpoint.
+func (m *bouncerMetrics) instrument(endpoint string, next http.RoundTripper) http.RoundTripper {
+	if m == nil {
+		return next
+	}
+
+	return &instrumentedTransport{next: next, metrics: m, endpoint: endpoint}
+}
+
+type instrumentedTransport struct {
+	next     http.RoundTripper
+	metrics  *bouncerMetrics
+	endpoint string
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+
+	resp, err := t.next.RoundTrip(req)
+
+	t.metrics.duration.WithLabelValues(t.endpoint, apiEndpoint(req.URL.Path)).Observe(time.Since(start).Seconds())
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+
+	t.metrics.requests.WithLabelValues(t.endpoint, code).Inc()
+
+	return resp, err
+}
+
+func (t *instrumentedTransport) CloseIdleConnections() {
+	if c, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,171 @@
+package csbouncer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBouncerMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("ip") == "6.6.6.6" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte("null"))
+	}))
+	t.Cleanup(server.Close)
+
+	lapi := newFakeLAPI(t, emptyStream)
+
+	reg := prometheus.NewPedanticRegistry()
+
+	live := &LiveBouncer{
+		APIUrl:            server.URL,
+		APIKey:            "key",
+		MetricsRegisterer: reg,
+		MetricsLabels:     prometheus.Labels{"bouncer": "live"},
+	}
+
+	if err := live.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the collectors registered by the first Init are reused
+	if err := live.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ip := range []string{"1.2.3.4", "5.6.7.8", "6.6.6.6"} {
+		_, _ = live.Get(context.Background(), ip)
+	}
+
+	stream := &StreamBouncer{
+		APIUrl:            lapi.URL,
+		APIKey:            "key",
+		TickerInterval:    "1h",
+		Store:             NewDecisionStore(),
+		MetricsRegisterer: reg,
+		MetricsLabels:     prometheus.Labels{"bouncer": "stream"},
+	}
+
+	runStreamBouncer(t, stream)
+
+	waitFor(t, func() bool { return lapi.callCount() == 1 })
+
+	expected := `
+# HELP lapi_client_requests_total The total number of requests to CrowdSec LAPI, by status code ('error' if there was no response)
+# TYPE lapi_client_requests_total counter
+lapi_client_requests_total{bouncer="live",code="200",lapi_url="URL1"} 2
+lapi_client_requests_total{bouncer="live",code="403",lapi_url="URL1"} 1
+lapi_client_requests_total{bouncer="stream",code="200",lapi_url="URL2"} 1
+`
+	expected = strings.NewReplacer("URL1", server.URL+"/", "URL2", lapi.URL+"/").Replace(expected)
+
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "lapi_client_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+
+	// another bouncer can't register its collectors with the same labels
+	same := &LiveBouncer{
+		APIUrl:            server.URL,
+		APIKey:            "key",
+		MetricsRegisterer: reg,
+		MetricsLabels:     prometheus.Labels{"bouncer": "live"},
+	}
+
+	if err := same.Init(); err == nil || !strings.Contains(err.Error(), "already registered by another bouncer") {
+		t.Fatalf("expected an error for the collectors of another bouncer, got %v", err)
+	}
+
+	// without a registerer, the collectors are available to the caller
+	other := &LiveBouncer{APIUrl: "http://127.0.0.1:1/", APIKey: "key"}
+
+	if other.Collector() != nil {
+		t.Fatal("expected no collector before Init")
+	}
+
+	if err := other.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = other.Get(context.Background(), "1.2.3.4")
+
+	if n := testutil.CollectAndCount(other.Collector(), "lapi_client_requests_total"); n != 1 {
+		t.Fatalf("expected 1 series, got %d", n)
+	}
+
+	if v := testutil.ToFloat64(other.metrics.requests.WithLabelValues("http://127.0.0.1:1/", "error")); v != 1 {
+		t.Fatalf("expected a failed request, got %v", v)
+	}
+
+	// the collectors of the decision stream are only for StreamBouncer
+	if n := testutil.CollectAndCount(other.Collector(), "lapi_stream_last_pull_timestamp_seconds", "active_decisions"); n != 0 {
+		t.Fatalf("expected no stream series for a LiveBouncer, got %d", n)
+	}
+}
+
+func TestStreamPullMetrics(t *testing.T) {
+	lapi := newFakeLAPI(t, func(url.Values) (int, string) {
+		return http.StatusOK, `{"new":[` +
+			`{"id":1,"duration":"1h","origin":"cscli","scenario":"manual","scope":"Ip","type":"ban","value":"1.2.3.4"},` +
+			`{"id":2,"duration":"1h","origin":"crowdsec","scenario":"ssh-bf","scope":"Ip","type":"ban","value":"5.6.7.8"},` +
+			`{"id":3,"duration":"1h","origin":"crowdsec","scenario":"ssh-bf","scope":"Ip","type":"captcha","value":"9.9.9.9"}],` +
+			`"deleted":[{"id":4,"duration":"-1s","origin":"crowdsec","scenario":"ssh-bf","scope":"Ip","type":"ban","value":"4.4.4.4"}]}`
+	})
+
+	b := &StreamBouncer{
+		APIUrl:         lapi.URL,
+		APIKey:         "key",
+		TickerInterval: "1h",
+		Store:          NewDecisionStore(),
+	}
+
+	start := time.Now().Unix()
+
+	runStreamBouncer(t, b)
+
+	waitFor(t, func() bool { return b.Store.Len() == 3 })
+
+	for _, tc := range []struct {
+		action, origin, typ string
+		want                float64
+	}{
+		{"new", "cscli", "ban", 1},
+		{"new", "crowdsec", "ban", 1},
+		{"new", "crowdsec", "captcha", 1},
+		{"deleted", "crowdsec", "ban", 1},
+	} {
+		if got := testutil.ToFloat64(b.metrics.decisions.WithLabelValues(tc.action, tc.origin, tc.typ)); got != tc.want {
+			t.Errorf("expected %v %s decisions from %s of type %s, got %v", tc.want, tc.action, tc.origin, tc.typ, got)
+		}
+	}
+
+	if got := testutil.ToFloat64(b.metrics.lastPull); got < float64(start) {
+		t.Errorf("expected the time of the last pull, got %v", got)
+	}
+
+	if n := testutil.CollectAndCount(b.metrics.duration, "lapi_client_request_duration_seconds"); n != 1 {
+		t.Errorf("expected 1 histogram, got %d", n)
+	}
+
+	for path, want := range map[string]string{
+		"/v1/decisions/stream": "decisions_stream",
+		"/v1/decisions":        "decisions_list",
+		"/v1/usage-metrics":    "usage_metrics",
+		"/v1/watchers/login":   "other",
+	} {
+		if got := apiEndpoint(path); got != want {
+			t.Errorf("expected %s for %s, got %s", want, path, got)
+		}
+	}
+}
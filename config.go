@@ -0,0 +1,177 @@
+package csbouncer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/parser"
+
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+	"github.com/crowdsecurity/go-cs-lib/csstring"
+	"github.com/crowdsecurity/go-cs-lib/csyaml"
+)
+
+// NewConfigReader reads a configuration file and, if it exists, the .yaml.local file with the
+// same name, whose values override the ones of the base file. Environment variables
+// referenced as $VAR or ${VAR} are expanded, undefined variables are left as they are.
+//
+// The result can be passed to the ConfigReader() or Reload() methods of both bouncer types.
+func NewConfigReader(configPath string) (io.Reader, error) {
+	patcher := csyaml.NewPatcher(configPath, ".local")
+
+	content, err := patcher.MergedPatchContent()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file '%s': %w", configPath, err)
+	}
+
+	return bytes.NewReader([]byte(csstring.StrictExpand(string(content), os.LookupEnv))), nil
+}
+
+// parseDuration parses a duration from the configuration, returning the default value if it's empty.
+func parseDuration(name string, value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse %s '%s': %w", name, value, err)
+	}
+
+	if d < 0 {
+		return 0, fmt.Errorf("%s must not be negative", name)
+	}
+
+	return d, nil
+}
+
+// unmarshalStrict rejects the unknown and duplicate keys of the configuration, then decodes
+// it with unmarshal, the decoder used without strict mode, so that the values are read the
+// same way. The errors report the line and column of the keys.
+func unmarshalStrict(content []byte, out any, unmarshal func([]byte, any) error) error {
+	file, err := parser.ParseBytes(content, 0)
+	if err != nil {
+		return errors.New(yaml.FormatError(err, false, false))
+	}
+
+	var errs []error
+
+	for _, doc := range file.Docs {
+		errs = append(errs, unknownKeys(doc.Body, reflect.TypeOf(out))...)
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	return unmarshal(content, out)
+}
+
+// yamlFields returns the types of the fields of a struct by key, named like yaml.v2 does:
+// from the yaml tag, or the lowercase name of the field.
+func yamlFields(t reflect.Type, fields map[string]reflect.Type) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	for i := range t.NumField() {
+		field := t.Field(i)
+
+		if !field.IsExported() {
+			continue
+		}
+
+		name, flags, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+
+		switch {
+		case name == "-":
+			continue
+		case strings.Contains(flags, "inline"):
+			yamlFields(field.Type, fields)
+			continue
+		case name == "":
+			name = strings.ToLower(field.Name)
+		}
+
+		fields[name] = field.Type
+	}
+}
+
+// unknownKeys returns an error for each key of the node that does not match a field of t.
+func unknownKeys(node ast.Node, t reflect.Type) []error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var errs []error
+
+	switch n := node.(type) {
+	case *ast.TagNode:
+		return unknownKeys(n.Value, t)
+	case *ast.AnchorNode:
+		return unknownKeys(n.Value, t)
+	case *ast.SequenceNode:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return nil
+		}
+
+		for _, value := range n.Values {
+			errs = append(errs, unknownKeys(value, t.Elem())...)
+		}
+	case *ast.MappingNode:
+		for _, value := range n.Values {
+			errs = append(errs, unknownKeys(value, t)...)
+		}
+	case *ast.MappingValueNode:
+		return unknownKey(n, t)
+	}
+
+	return errs
+}
+
+// unknownKey returns an error if the key of the mapping does not match a field of t, or
+// the errors of its value.
+func unknownKey(n *ast.MappingValueNode, t reflect.Type) []error {
+	switch {
+	case t.Kind() == reflect.Map:
+		return unknownKeys(n.Value, t.Elem())
+	case t.Kind() != reflect.Struct, n.Key.IsMergeKey():
+		return nil
+	}
+
+	fields := make(map[string]reflect.Type)
+	yamlFields(t, fields)
+
+	tk := n.Key.GetToken()
+
+	field, ok := fields[tk.Value]
+	if !ok {
+		return []error{fmt.Errorf("[%d:%d] unknown field %q", tk.Position.Line, tk.Position.Column, tk.Value)}
+	}
+
+	return unknownKeys(n.Value, field)
+}
+
+// validateScopes returns an error for each scope that is not built into CrowdSec. Custom
+// scopes are valid, these errors are only fatal with a strict configuration.
+func validateScopes(scopes []string) []error {
+	var errs []error
+
+	for _, scope := range scopes {
+		switch strings.ToLower(scope) {
+		case strings.ToLower(types.Ip), strings.ToLower(types.Range), strings.ToLower(types.Country), strings.ToLower(types.AS):
+		default:
+			errs = append(errs, fmt.Errorf("unknown scope '%s'", scope))
+		}
+	}
+
+	return errs
+}
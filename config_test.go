@@ -0,0 +1,224 @@
+package csbouncer_test
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	csbouncer "github.com/crowdsecurity/go-cs-bouncer"
+)
+
+func TestNewConfigReader(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "bouncer.yaml")
+
+	base := `api_url: http://localhost:8080/
+api_key: ${TEST_BOUNCER_API_KEY}
+update_frequency: 10s
+scopes:
+  - ip
+`
+
+	local := `update_frequency: 30s
+scopes:
+  - range
+`
+
+	if err := os.WriteFile(configPath, []byte(base), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(configPath+".local", []byte(local), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("TEST_BOUNCER_API_KEY", "secret")
+
+	reader, err := csbouncer.NewConfigReader(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bouncer := &csbouncer.StreamBouncer{}
+
+	if err := bouncer.ConfigReader(reader); err != nil {
+		t.Fatal(err)
+	}
+
+	if bouncer.APIKey != "secret" {
+		t.Errorf("expected the API key from the environment, got '%s'", bouncer.APIKey)
+	}
+
+	if bouncer.TickerInterval != "30s" {
+		t.Errorf("expected update_frequency from the .local file, got '%s'", bouncer.TickerInterval)
+	}
+
+	if len(bouncer.Scopes) != 1 || bouncer.Scopes[0] != "range" {
+		t.Errorf("expected scopes from the .local file, got %v", bouncer.Scopes)
+	}
+
+	if bouncer.APIUrl != "http://localhost:8080/" {
+		t.Errorf("expected api_url from the base file, got '%s'", bouncer.APIUrl)
+	}
+
+	if _, err := csbouncer.NewConfigReader(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestStrictConfig(t *testing.T) {
+	config := `api_url: http://localhost:8080/
+api_key: secret
+scenario_containing:
+  - ssh
+`
+
+	bouncer := &csbouncer.StreamBouncer{}
+
+	if err := bouncer.ConfigReader(strings.NewReader(config)); err != nil {
+		t.Fatalf("unknown keys should be ignored by default: %s", err)
+	}
+
+	bouncer = &csbouncer.StreamBouncer{StrictConfig: true}
+
+	err := bouncer.ConfigReader(strings.NewReader(config))
+	if err == nil {
+		t.Fatal("expected an error for an unknown key")
+	}
+
+	if !strings.Contains(err.Error(), `[3:1] unknown field "scenario_containing"`) {
+		t.Errorf("expected the position of the unknown key, got: %s", err)
+	}
+
+	live := &csbouncer.LiveBouncer{StrictConfig: true}
+
+	err = live.ConfigReader(strings.NewReader("api_url: http://localhost:8080/\ncache:\n  enabled: true\n  sizee: 10\n"))
+	if err == nil || !strings.Contains(err.Error(), `[4:3] unknown field "sizee"`) {
+		t.Errorf("expected an error for an unknown nested key, got: %v", err)
+	}
+
+	if err := live.ConfigReader(strings.NewReader("api_url: http://localhost:8080/\napi_url: http://localhost:8081/\n")); err == nil {
+		t.Error("expected an error for a duplicate key")
+	}
+
+	// the values are read the same way as without strict mode
+	config = "api_url: http://localhost:8080/\napi_key: secret\ninsecure_skip_verify: yes\n"
+
+	for _, strict := range []bool{false, true} {
+		live = &csbouncer.LiveBouncer{StrictConfig: strict}
+
+		if err := live.ConfigReader(strings.NewReader(config)); err != nil {
+			t.Fatalf("strict %v: %s", strict, err)
+		}
+
+		if live.InsecureSkipVerify == nil || !*live.InsecureSkipVerify {
+			t.Errorf("strict %v: expected insecure_skip_verify to be true", strict)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+
+	bouncer := &csbouncer.StreamBouncer{
+		APIUrl:         "ftp://localhost:8080/",
+		APIKey:         "secret",
+		CertPath:       filepath.Join(dir, "missing.pem"),
+		KeyPath:        filepath.Join(dir, "missing-key.pem"),
+		CAPath:         filepath.Join(dir, "missing-ca.pem"),
+		Scopes:         []string{"ip", "subnet"},
+		TickerInterval: "0s",
+		StrictConfig:   true,
+	}
+
+	err := bouncer.Validate()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	for _, expected := range []string{
+		"scheme must be http, https or unix",
+		"cannot use both API key and certificate auth",
+		"unable to load certificate",
+		"unable to load CA certificate",
+		"unknown scope 'subnet'",
+		"lapi update interval must be positive",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected '%s' in: %s", expected, err)
+		}
+	}
+
+	if strings.Contains(err.Error(), "'ip'") {
+		t.Errorf("scopes should be case insensitive: %s", err)
+	}
+
+	bouncer = &csbouncer.StreamBouncer{
+		APIUrl:   "http://localhost:8080/",
+		CertPath: filepath.Join(dir, "cert.pem"),
+	}
+
+	err = bouncer.Validate()
+	if err == nil || !strings.Contains(err.Error(), "cert_path and key_path must be set together") {
+		t.Errorf("expected an error for a certificate without a key, got: %v", err)
+	}
+
+	bouncer = &csbouncer.StreamBouncer{
+		APIUrl: "http://localhost:8080/",
+		APIKey: "secret",
+		Scopes: []string{"Ip", "range", "country", "as"},
+	}
+
+	if err := bouncer.Validate(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// custom scopes are only rejected by a strict configuration
+	bouncer = &csbouncer.StreamBouncer{
+		APIUrl: "http://localhost:8080/",
+		APIKey: "secret",
+		Scopes: []string{"ip", "username"},
+	}
+
+	if err := bouncer.Init(); err != nil {
+		t.Errorf("unexpected error for a custom scope: %s", err)
+	}
+
+	live := &csbouncer.LiveBouncer{
+		FailurePolicy: "maybe",
+	}
+
+	err = live.Validate()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	for _, expected := range []string{
+		"config does not contain LAPI url",
+		"config does not contain LAPI key or certificate",
+		"unknown failure_policy 'maybe'",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected '%s' in: %s", expected, err)
+		}
+	}
+}
+
+func ExampleNewConfigReader() {
+	reader, err := csbouncer.NewConfigReader("/etc/crowdsec/bouncers/crowdsec-custom-bouncer.yaml")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bouncer := &csbouncer.LiveBouncer{}
+
+	if err := bouncer.ConfigReader(reader); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := bouncer.Init(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,262 @@
+package csbouncer
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+)
+
+// DecisionStore keeps the set of active decisions up to date by applying the
+// deltas received from the LAPI. It can be attached to a StreamBouncer and is
+// safe to query from multiple goroutines while the bouncer is running.
+type DecisionStore struct {
+	mu sync.RWMutex
+	// scope+value -> decision id -> decision
+	decisions map[storeKey]map[string]*models.Decision
+	ranges    *RangeIndex
+	count     int
+}
+
+type storeKey struct {
+	scope string
+	value string
+}
+
+func NewDecisionStore() *DecisionStore {
+	return &DecisionStore{
+		decisions: make(map[storeKey]map[string]*models.Decision),
+		ranges:    NewRangeIndex(),
+	}
+}
+
+// normalizeScope returns the scope in lower case, so that "Ip" and "ip" are the same.
+func normalizeScope(scope string) string {
+	return strings.ToLower(scope)
+}
+
+// normalizeValue returns the canonical form of IP addresses and ranges,
+// other values are returned as is.
+func normalizeValue(scope string, value string) string {
+	switch scope {
+	case normalizeScope(types.Ip):
+		if addr, err := netip.ParseAddr(value); err == nil {
+			return addr.Unmap().String()
+		}
+	case normalizeScope(types.Range):
+		if prefix, err := netip.ParsePrefix(value); err == nil {
+			return normalizePrefix(prefix).String()
+		}
+	}
+
+	return value
+}
+
+// decisionID identifies a decision inside a scope+value, so that a deleted
+// decision only removes the one with the same identity.
+func decisionID(d *models.Decision) string {
+	if d.UUID != "" {
+		return d.UUID
+	}
+
+	if d.ID != 0 {
+		return strconv.FormatInt(d.ID, 10)
+	}
+
+	return fmt.Sprintf("%s/%s/%s", deref(d.Origin), deref(d.Type), deref(d.Scenario))
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+
+	return *s
+}
+
+func newStoreKey(d *models.Decision) (storeKey, bool) {
+	if d == nil || d.Scope == nil || d.Value == nil {
+		return storeKey{}, false
+	}
+
+	scope := normalizeScope(*d.Scope)
+
+	return storeKey{scope: scope, value: normalizeValue(scope, *d.Value)}, true
+}
+
+// Apply updates the store with a response from the decision stream.
+// Deleted decisions are processed before the new ones.
+func (s *DecisionStore) Apply(resp *models.DecisionsStreamResponse) {
+	if resp == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range resp.Deleted {
+		s.delete(d)
+	}
+
+	for _, d := range resp.New {
+		s.add(d)
+	}
+}
+
+// Replace discards the content of the store and replaces it with the given decisions,
+// typically the New list of a snapshot (see StreamUpdate).
+func (s *DecisionStore) Replace(decisions []*models.Decision) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.decisions = make(map[storeKey]map[string]*models.Decision)
+	s.ranges = NewRangeIndex()
+	s.count = 0
+
+	for _, d := range decisions {
+		s.add(d)
+	}
+}
+
+// Add inserts decisions in the store, replacing the ones with the same identity.
+func (s *DecisionStore) Add(decisions ...*models.Decision) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range decisions {
+		s.add(d)
+	}
+}
+
+// Delete removes decisions from the store. Unknown decisions are ignored.
+func (s *DecisionStore) Delete(decisions ...*models.Decision) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range decisions {
+		s.delete(d)
+	}
+}
+
+func (s *DecisionStore) add(d *models.Decision) {
+	key, ok := newStoreKey(d)
+	if !ok {
+		return
+	}
+
+	byID, ok := s.decisions[key]
+	if !ok {
+		byID = make(map[string]*models.Decision)
+		s.decisions[key] = byID
+	}
+
+	id := decisionID(d)
+	if _, ok := byID[id]; !ok {
+		s.count++
+	}
+
+	byID[id] = d
+
+	if key.scope == normalizeScope(types.Range) {
+		s.ranges.Add(d)
+	}
+}
+
+func (s *DecisionStore) delete(d *models.Decision) {
+	key, ok := newStoreKey(d)
+	if !ok {
+		return
+	}
+
+	byID, ok := s.decisions[key]
+	if !ok {
+		return
+	}
+
+	id := decisionID(d)
+	if _, ok := byID[id]; !ok {
+		return
+	}
+
+	delete(byID, id)
+	s.count--
+
+	if key.scope == normalizeScope(types.Range) {
+		s.ranges.Delete(d)
+	}
+
+	if len(byID) == 0 {
+		delete(s.decisions, key)
+	}
+}
+
+// Get returns the active decisions for an exact scope and value, like
+// ("Ip", "1.2.3.4"), ("Range", "1.2.3.0/24") or ("Country", "FR").
+// Scopes are case insensitive.
+func (s *DecisionStore) Get(scope string, value string) []*models.Decision {
+	scope = normalizeScope(scope)
+	key := storeKey{scope: scope, value: normalizeValue(scope, value)}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return collect(s.decisions[key])
+}
+
+// GetIP returns the decisions that apply to an IP address: the ones with the
+// Ip scope for the same address, and the ones with a Range scope that contains it.
+func (s *DecisionStore) GetIP(ip string) ([]*models.Decision, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP address '%s': %w", ip, err)
+	}
+
+	addr = addr.Unmap()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ret := collect(s.decisions[storeKey{scope: normalizeScope(types.Ip), value: addr.String()}])
+	ret = append(ret, s.ranges.Lookup(addr)...)
+
+	return ret, nil
+}
+
+// Len returns the number of active decisions in the store.
+func (s *DecisionStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.count
+}
+
+// all returns all the active decisions.
+func (s *DecisionStore) all() []*models.Decision {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ret := make([]*models.Decision, 0, s.count)
+
+	for _, byID := range s.decisions {
+		ret = append(ret, collect(byID)...)
+	}
+
+	return ret
+}
+
+func collect(byID map[string]*models.Decision) []*models.Decision {
+	if len(byID) == 0 {
+		return nil
+	}
+
+	ret := make([]*models.Decision, 0, len(byID))
+	for _, d := range byID {
+		ret = append(ret, d)
+	}
+
+	return ret
+}
@@ -0,0 +1,140 @@
+package csbouncer_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+
+	csbouncer "github.com/crowdsecurity/go-cs-bouncer"
+)
+
+func newDecision(id int64, scope string, value string, typ string) *models.Decision {
+	origin := "crowdsec"
+	scenario := "crowdsecurity/ssh-bf"
+	duration := "4h"
+
+	return &models.Decision{
+		ID:       id,
+		Scope:    &scope,
+		Value:    &value,
+		Type:     &typ,
+		Origin:   &origin,
+		Scenario: &scenario,
+		Duration: &duration,
+	}
+}
+
+func TestDecisionStoreApply(t *testing.T) {
+	store := csbouncer.NewDecisionStore()
+
+	store.Apply(&models.DecisionsStreamResponse{
+		New: models.GetDecisionsResponse{
+			newDecision(1, "Ip", "1.2.3.4", "ban"),
+			newDecision(2, "ip", "1.2.3.4", "captcha"),
+			newDecision(3, "Range", "10.0.0.0/8", "ban"),
+			newDecision(4, "Country", "FR", "captcha"),
+		},
+	})
+
+	if got := store.Len(); got != 4 {
+		t.Fatalf("expected 4 decisions, got %d", got)
+	}
+
+	if got := len(store.Get("IP", "1.2.3.4")); got != 2 {
+		t.Errorf("expected 2 decisions for 1.2.3.4, got %d", got)
+	}
+
+	if got := len(store.Get("country", "FR")); got != 1 {
+		t.Errorf("expected 1 decision for FR, got %d", got)
+	}
+
+	store.Apply(&models.DecisionsStreamResponse{
+		Deleted: models.GetDecisionsResponse{
+			newDecision(1, "Ip", "1.2.3.4", "ban"),
+			// unknown decisions are ignored
+			newDecision(42, "Ip", "1.2.3.4", "ban"),
+		},
+	})
+
+	if got := store.Len(); got != 3 {
+		t.Fatalf("expected 3 decisions, got %d", got)
+	}
+
+	decisions := store.Get("Ip", "1.2.3.4")
+	if len(decisions) != 1 || *decisions[0].Type != "captcha" {
+		t.Errorf("expected the captcha decision to remain, got %v", decisions)
+	}
+}
+
+func TestDecisionStoreGetIP(t *testing.T) {
+	store := csbouncer.NewDecisionStore()
+
+	store.Add(
+		newDecision(1, "Ip", "2001:db8::1", "ban"),
+		newDecision(2, "Range", "2001:db8::/32", "captcha"),
+		newDecision(3, "Range", "1.2.3.0/24", "ban"),
+	)
+
+	tests := []struct {
+		ip       string
+		expected int
+	}{
+		{"2001:0db8:0000::1", 2},
+		{"2001:db8::2", 1},
+		{"1.2.3.4", 1},
+		{"::ffff:1.2.3.4", 1},
+		{"1.2.4.1", 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.ip, func(t *testing.T) {
+			decisions, err := store.GetIP(tc.ip)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(decisions) != tc.expected {
+				t.Errorf("expected %d decisions, got %d", tc.expected, len(decisions))
+			}
+		})
+	}
+
+	if _, err := store.GetIP("not-an-ip"); err == nil {
+		t.Error("expected an error for an invalid IP")
+	}
+}
+
+func ExampleDecisionStore() {
+	store := csbouncer.NewDecisionStore()
+
+	bouncer := &csbouncer.StreamBouncer{
+		APIKey: "ebd4db481d51525fd0df924a69193921",
+		APIUrl: "http://localhost:8080/",
+		Store:  store,
+	}
+
+	if err := bouncer.Init(); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		if err := bouncer.Run(ctx); err != nil {
+			log.Fatal(err.Error())
+		}
+	}()
+
+	decisions, err := store.GetIP("1.2.3.4")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, decision := range decisions {
+		fmt.Printf("decision: %s | Scope: %s | Value: %s\n", *decision.Type, *decision.Scope, *decision.Value)
+	}
+}
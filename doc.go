@@ -3,6 +3,7 @@
 // It can be used to create 2 types of bouncer:
 //
 // - A stream bouncer: in this mode, decisions are fetched in bulk at regular intervals. A `Stream` chan is exposed by the struct to allow you to read the decisions.
+// A `DecisionStore` can also be attached to the bouncer, to keep the active decisions in memory and query them directly.
 //
 // - A live bouncer: in this mode, you must call the Get() method to check if an IP has a decision associated with it.
 package csbouncer
@@ -0,0 +1,204 @@
+package csbouncer
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// How LiveBouncer spreads the requests over the LAPI endpoints.
+const (
+	// LoadBalancingFailover sends the requests to the first healthy endpoint, in the order
+	// of the configuration. This is the default, and the only mode of StreamBouncer.
+	LoadBalancingFailover = "failover"
+	// LoadBalancingRoundRobin sends the requests to each healthy endpoint in turn.
+	LoadBalancingRoundRobin = "round_robin"
+)
+
+// how long an endpoint that has failed is skipped, unless all the others have failed too
+const endpointRetryInterval = 30 * time.Second
+
+type endpoint struct {
+	// as in the configuration
+	name string
+	// where the requests are sent
+	base      *url.URL
+	transport http.RoundTripper
+	// last failure, zero if the endpoint is healthy
+	failedAt time.Time
+}
+
+// endpointSet is the transport of an API client with several LAPI endpoints. The requests are
+// sent to one of them, the others are tried in turn if it can't be reached or returns an
+// error 5xx. An endpoint that has failed is skipped for a while.
+type endpointSet struct {
+	endpoints []*endpoint
+	// base URL of the API client, replaced by the one of the endpoint in the requests
+	base          *url.URL
+	roundRobin    bool
+	retryInterval time.Duration
+	logger        logrus.FieldLogger
+
+	mu     sync.Mutex
+	active *endpoint
+
+	next atomic.Uint64
+
+	// overridden by tests
+	now func() time.Time
+}
+
+func newEndpointSet(endpoints []*endpoint, roundRobin bool, logger logrus.FieldLogger) *endpointSet {
+	return &endpointSet{
+		endpoints:     endpoints,
+		base:          endpoints[0].base,
+		roundRobin:    roundRobin,
+		retryInterval: endpointRetryInterval,
+		logger:        logger,
+		active:        endpoints[0],
+		now:           time.Now,
+	}
+}
+
+// Active returns the endpoint that answered the last request.
+func (s *endpointSet) Active() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.active.name
+}
+
+// order returns the endpoints in the order they must be tried: the healthy ones first.
+func (s *endpointSet) order() []*endpoint {
+	n := len(s.endpoints)
+
+	start := 0
+	if s.roundRobin {
+		// in uint64, the counter would be negative as an int on 32-bit platforms
+		start = int((s.next.Add(1) - 1) % uint64(n))
+	}
+
+	healthy := make([]*endpoint, 0, n)
+
+	var failed []*endpoint
+
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range n {
+		e := s.endpoints[(start+i)%n]
+
+		if e.failedAt.IsZero() || now.Sub(e.failedAt) >= s.retryInterval {
+			healthy = append(healthy, e)
+		} else {
+			failed = append(failed, e)
+		}
+	}
+
+	return append(healthy, failed...)
+}
+
+func (s *endpointSet) succeeded(e *endpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.failedAt = time.Time{}
+
+	if s.active != e {
+		s.logger.Infof("using LAPI endpoint %s", e.name)
+		s.active = e
+	}
+}
+
+func (s *endpointSet) failed(e *endpoint, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.failedAt = s.now()
+
+	if len(s.endpoints) > 1 {
+		s.logger.Warningf("LAPI endpoint %s failed: %s", e.name, reason)
+	}
+}
+
+// request returns a copy of the request for the endpoint.
+func (s *endpointSet) request(req *http.Request, e *endpoint, body io.ReadCloser) *http.Request {
+	r := req.Clone(req.Context())
+	r.Body = body
+
+	u := *e.base
+	u.Path = e.base.Path + strings.TrimPrefix(req.URL.Path, s.base.Path)
+	u.RawPath = ""
+	u.RawQuery = req.URL.RawQuery
+	r.URL = &u
+	r.Host = ""
+
+	return r
+}
+
+func (s *endpointSet) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoints := s.order()
+	body := req.Body
+	replayable := body == nil || body == http.NoBody || req.GetBody != nil
+
+	for i, e := range endpoints {
+		if i > 0 && body != nil && body != http.NoBody {
+			// the body has been consumed by the previous attempt
+			var err error
+
+			body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := e.transport.RoundTrip(s.request(req, e, body))
+
+		var reason string
+
+		switch {
+		case err != nil:
+			reason = err.Error()
+		case resp.StatusCode >= http.StatusInternalServerError:
+			reason = resp.Status
+		default:
+			s.succeeded(e)
+			return resp, nil
+		}
+
+		// the request has been abandoned, it tells nothing about the endpoint
+		if req.Context().Err() != nil {
+			return resp, err
+		}
+
+		s.failed(e, reason)
+
+		if i == len(endpoints)-1 || !replayable {
+			return resp, err
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+
+	return nil, errors.New("no LAPI endpoint")
+}
+
+func (s *endpointSet) CloseIdleConnections() {
+	for _, e := range s.endpoints {
+		if t, ok := e.transport.(interface{ CloseIdleConnections() }); ok {
+			t.CloseIdleConnections()
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package csbouncer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testEndpoint returns an endpoint whose transport records the requests and answers with the
+// given status, or fails if it's zero.
+func testEndpoint(t *testing.T, name string, status *int, paths *[]string) *endpoint {
+	t.Helper()
+
+	base, err := url.Parse(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &endpoint{
+		name: name,
+		base: base,
+		transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			*paths = append(*paths, req.URL.String())
+
+			if *status == 0 {
+				return nil, errors.New("connection refused")
+			}
+
+			return &http.Response{
+				StatusCode: *status,
+				Status:     http.StatusText(*status),
+				Body:       io.NopCloser(strings.NewReader("")),
+				Request:    req,
+			}, nil
+		}),
+	}
+}
+
+func TestEndpointSet(t *testing.T) {
+	var requests []string
+
+	status1, status2 := http.StatusOK, http.StatusOK
+
+	set := newEndpointSet([]*endpoint{
+		testEndpoint(t, "http://lapi1:8080/", &status1, &requests),
+		testEndpoint(t, "http://lapi2:8080/prefix/", &status2, &requests),
+	}, false, logrus.StandardLogger())
+
+	now := time.Now()
+	set.now = func() time.Time { return now }
+
+	send := func() int {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodPost, "http://lapi1:8080/v1/decisions?ip=1.2.3.4", strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := set.RoundTrip(req)
+		if err != nil {
+			return 0
+		}
+
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	if send() != http.StatusOK || set.Active() != "http://lapi1:8080/" {
+		t.Fatalf("expected the first endpoint to answer, got %v", requests)
+	}
+
+	status1 = 0
+	requests = nil
+
+	if send() != http.StatusOK || set.Active() != "http://lapi2:8080/prefix/" {
+		t.Fatalf("expected a failover to the second endpoint, got %v", requests)
+	}
+
+	if len(requests) != 2 || requests[1] != "http://lapi2:8080/prefix/v1/decisions?ip=1.2.3.4" {
+		t.Fatalf("expected the url to be rewritten for the second endpoint, got %v", requests)
+	}
+
+	// the failed endpoint is skipped for a while
+	status1 = http.StatusOK
+	requests = nil
+
+	if send() != http.StatusOK || len(requests) != 1 || !strings.HasPrefix(requests[0], "http://lapi2:8080/") {
+		t.Fatalf("expected the failed endpoint to be skipped, got %v", requests)
+	}
+
+	now = now.Add(endpointRetryInterval)
+	requests = nil
+
+	if send() != http.StatusOK || set.Active() != "http://lapi1:8080/" {
+		t.Fatalf("expected the first endpoint to be used again, got %v", requests)
+	}
+
+	// the last error is returned when all the endpoints fail
+	status1, status2 = http.StatusBadGateway, http.StatusServiceUnavailable
+
+	if got := send(); got != http.StatusServiceUnavailable {
+		t.Fatalf("expected the last response, got %d", got)
+	}
+
+	// a client error is an answer
+	status1, status2 = http.StatusForbidden, http.StatusOK
+	now = now.Add(endpointRetryInterval)
+	requests = nil
+
+	if send() != http.StatusForbidden || len(requests) != 1 {
+		t.Fatalf("expected no failover on a 4xx, got %v", requests)
+	}
+}
+
+func TestEndpointSetRoundRobin(t *testing.T) {
+	var requests []string
+
+	status := http.StatusOK
+
+	set := newEndpointSet([]*endpoint{
+		testEndpoint(t, "http://lapi1:8080/", &status, &requests),
+		testEndpoint(t, "http://lapi2:8080/", &status, &requests),
+	}, true, logrus.StandardLogger())
+
+	// the counter does not fit in an int
+	set.next.Store(1 << 63)
+
+	for range 4 {
+		req, err := http.NewRequest(http.MethodGet, "http://lapi1:8080/v1/decisions", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := set.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+	}
+
+	want := []string{
+		"http://lapi1:8080/v1/decisions",
+		"http://lapi2:8080/v1/decisions",
+		"http://lapi1:8080/v1/decisions",
+		"http://lapi2:8080/v1/decisions",
+	}
+
+	if strings.Join(requests, " ") != strings.Join(want, " ") {
+		t.Fatalf("expected the requests to alternate, got %v", requests)
+	}
+}
+
+func TestEndpointsValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		b    *LiveBouncer
+		want []string
+	}{
+		{
+			name: "api_url and api_urls",
+			b:    &LiveBouncer{APIKey: "key", APIUrl: "http://lapi1:8080/", APIUrls: []string{"http://lapi2:8080/"}},
+			want: []string{"api_url and api_urls are mutually exclusive"},
+		},
+		{
+			name: "invalid",
+			b:    &LiveBouncer{APIKey: "key", APIUrls: []string{"http://lapi1:8080/", "ftp://lapi2/"}, LoadBalancing: "random"},
+			want: []string{"scheme must be http, https or unix", "unknown load_balancing 'random'"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.b.Validate()
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			for _, want := range tc.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected '%s' in: %s", want, err)
+				}
+			}
+		})
+	}
+
+	b := &LiveBouncer{APIKey: "key", APIUrls: []string{"http://lapi1:8080/", "unix:///run/lapi.sock"}, LoadBalancing: LoadBalancingRoundRobin}
+
+	if err := b.Validate(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestStreamBouncerEndpointSwitch(t *testing.T) {
+	lapi1 := newFakeLAPI(t, emptyStream)
+	lapi2 := newFakeLAPI(t, func(q url.Values) (int, string) {
+		if q.Get("startup") == "true" {
+			return http.StatusOK, `{"new":[{"id":1,"duration":"1h","origin":"cscli","scenario":"manual","scope":"Ip","type":"ban","value":"1.2.3.4"}]}`
+		}
+
+		// a delta from the second LAPI
+		return http.StatusOK, `{"new":[{"id":2,"duration":"1h","origin":"cscli","scenario":"manual","scope":"Ip","type":"ban","value":"5.6.7.8"}]}`
+	})
+
+	b := &StreamBouncer{
+		APIKey:         "key",
+		APIUrls:        []string{lapi1.URL, lapi2.URL},
+		TickerInterval: "1h",
+		Store:          NewDecisionStore(),
+	}
+
+	runStreamBouncer(t, b)
+
+	waitFor(t, func() bool { return lapi1.callCount() == 1 })
+
+	lapi1.mu.Lock()
+	lapi1.respond = func(url.Values) (int, string) {
+		return http.StatusInternalServerError, `{"message":"down"}`
+	}
+	lapi1.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := b.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.ActiveEndpoint() != lapi2.URL+"/" {
+		t.Fatalf("expected the second LAPI to be active, got %s", b.ActiveEndpoint())
+	}
+
+	// the deltas of the first LAPI mean nothing to the second one, the refresh
+	// is done once all the decisions have been pulled
+	if n := lapi2.callCount(); n != 2 {
+		t.Fatalf("expected 2 calls to the second LAPI, got %d", n)
+	}
+
+	if lapi2.lastCall().Get("startup") != "true" {
+		t.Fatalf("expected a full pull after the switch, got %v", lapi2.lastCall())
+	}
+
+	if len(b.Store.Get("Ip", "1.2.3.4")) != 1 || b.Store.Len() != 1 {
+		t.Fatalf("expected only the decisions of the full pull, got %d decisions", b.Store.Len())
+	}
+}
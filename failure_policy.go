@@ -0,0 +1,136 @@
+package csbouncer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+)
+
+// What LiveBouncer.Get returns when the LAPI can't be reached.
+const (
+	// FailurePolicyError returns the error to the caller. This is the default.
+	FailurePolicyError = "error"
+	// FailurePolicyOpen returns no decision, the traffic is allowed.
+	FailurePolicyOpen = "open"
+	// FailurePolicyClosed returns a decision with the remediation from failure_remediation.
+	FailurePolicyClosed = "closed"
+	// FailurePolicyCache returns the last known answer from the cache, even if it has expired.
+	// If there is none, the error is returned.
+	FailurePolicyCache = "cache"
+)
+
+const (
+	defaultFailureRemediation = "ban"
+	// origin of the decisions returned by the fail-closed policy
+	failureOrigin   = "lapi-unavailable"
+	failureScenario = "lapi-unavailable"
+)
+
+// minimum interval between the warnings of the failure policy
+const failureLogInterval = 10 * time.Second
+
+// failureLog limits the warnings of the failure policy, which applies to every request
+// while the LAPI can't be reached. The zero value is ready to use.
+type failureLog struct {
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+
+	// overridden by tests
+	now func() time.Time
+}
+
+func (l *failureLog) warnf(format string, args ...any) {
+	l.mu.Lock()
+
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+
+	if !l.last.IsZero() && now.Sub(l.last) < failureLogInterval {
+		l.suppressed++
+		l.mu.Unlock()
+
+		return
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	if l.suppressed > 0 {
+		msg += fmt.Sprintf(" (%d similar messages suppressed)", l.suppressed)
+	}
+
+	l.last = now
+	l.suppressed = 0
+	l.mu.Unlock()
+
+	logrus.Warn(msg)
+}
+
+func (b *LiveBouncer) validateFailurePolicy() error {
+	switch b.FailurePolicy {
+	case "", FailurePolicyError, FailurePolicyOpen, FailurePolicyClosed:
+		return nil
+	case FailurePolicyCache:
+		if !b.Cache.Enabled {
+			return fmt.Errorf("failure_policy '%s' requires the cache to be enabled", b.FailurePolicy)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unknown failure_policy '%s'", b.FailurePolicy)
+	}
+}
+
+// onFailure applies the failure policy to a LAPI error.
+func (s lookupSettings) onFailure(value string, err error) (*models.GetDecisionsResponse, error) {
+	remediation := s.failureRemediation
+	if remediation == "" {
+		remediation = defaultFailureRemediation
+	}
+
+	switch s.failurePolicy {
+	case FailurePolicyOpen:
+		s.failureLog.warnf("LAPI unavailable, allowing '%s': %s", value, err)
+
+		return &models.GetDecisionsResponse{}, nil
+	case FailurePolicyClosed:
+		s.failureLog.warnf("LAPI unavailable, applying '%s' to '%s': %s", remediation, value, err)
+
+		return failureDecision(value, remediation), nil
+	case FailurePolicyCache:
+		if s.cache != nil {
+			if decisions, ok := s.cache.getStale(value); ok {
+				s.failureLog.warnf("LAPI unavailable, using the last known decisions for '%s': %s", value, err)
+
+				return decisions, nil
+			}
+		}
+	}
+
+	return nil, err
+}
+
+func failureDecision(value string, remediation string) *models.GetDecisionsResponse {
+	scope := types.Ip
+	origin := failureOrigin
+	scenario := failureScenario
+	// not a real decision, it applies as long as the LAPI can't be reached
+	duration := "0s"
+
+	return &models.GetDecisionsResponse{
+		{
+			Scope:    &scope,
+			Value:    &value,
+			Type:     &remediation,
+			Origin:   &origin,
+			Scenario: &scenario,
+			Duration: &duration,
+		},
+	}
+}
@@ -0,0 +1,71 @@
+package csbouncer
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// how often a watched file is checked for changes
+const defaultFileCheckInterval = 5 * time.Second
+
+// fileWatcher detects the changes of a file by polling its modification time and
+// size, at most once per interval. It follows symlinks, so the files of a
+// Kubernetes secret or config map are seen as changed when the volume is updated.
+type fileWatcher struct {
+	path     string
+	interval time.Duration
+
+	mu        sync.Mutex
+	modTime   time.Time
+	size      int64
+	checkedAt time.Time
+
+	// overridden by tests
+	now func() time.Time
+}
+
+func newFileWatcher(path string) *fileWatcher {
+	w := &fileWatcher{
+		path:     path,
+		interval: defaultFileCheckInterval,
+		now:      time.Now,
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		w.modTime = info.ModTime()
+		w.size = info.Size()
+	}
+
+	w.checkedAt = w.now()
+
+	return w
+}
+
+// changed reports whether the file has been modified since the last time it returned true.
+// A file that can't be read is not considered as changed.
+func (w *fileWatcher) changed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.now()
+	if now.Sub(w.checkedAt) < w.interval {
+		return false
+	}
+
+	w.checkedAt = now
+
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return false
+	}
+
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return false
+	}
+
+	w.modTime = info.ModTime()
+	w.size = info.Size()
+
+	return true
+}
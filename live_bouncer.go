@@ -5,10 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 
@@ -18,20 +21,86 @@ import (
 
 type LiveBouncer struct {
 	APIKey             string `yaml:"api_key"`
-	APIUrl             string `yaml:"api_url"`
+	APIUrl             string `yaml:"api_url"` // http(s)://host:port/ or unix:///path/to/socket
 	InsecureSkipVerify *bool  `yaml:"insecure_skip_verify"`
 	CertPath           string `yaml:"cert_path"`
 	KeyPath            string `yaml:"key_path"`
 	CAPath             string `yaml:"ca_cert_path"`
 
+	// read the API key from a file, which is read again when it changes, or from the
+	// output of a shell command, instead of api_key. Trailing newlines are removed.
+	APIKeyFile    string `yaml:"api_key_file"`
+	APIKeyCommand string `yaml:"api_key_command"`
+
+	// how long before the expiry of the client certificate or of the CA to log a warning,
+	// 720h (30 days), 168h (7 days) and 24h by default
+	CertExpiryWarnings []string `yaml:"cert_expiry_warnings"`
+
+	TLS TLSConfig `yaml:"tls"`
+
+	// HTTP CONNECT (http:// or https://) or SOCKS5 (socks5://) proxy to reach the LAPI,
+	// and comma-separated hosts that must not go through it. If not set, the HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY environment variables are used.
+	ProxyURL string `yaml:"proxy_url"`
+	NoProxy  string `yaml:"no_proxy"`
+
+	Timeouts TimeoutConfig `yaml:"timeouts"`
+
+	Cache          CacheConfig          `yaml:"cache"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	// what Get returns when the LAPI can't be reached: error, open, closed or cache
+	FailurePolicy      string `yaml:"failure_policy"`
+	FailureRemediation string `yaml:"failure_remediation"`
+
+	// several LAPI urls, in the order of priority, instead of api_url. The requests are
+	// sent to the first one that is healthy, or to each of them in turn with
+	// load_balancing: round_robin.
+	APIUrls       []string `yaml:"api_urls"`
+	LoadBalancing string   `yaml:"load_balancing"`
+
 	APIClient *apiclient.ApiClient
 	UserAgent string
 
 	MetricsInterval time.Duration
+
+	// StrictConfig makes ConfigReader reject unknown or duplicate keys, reporting
+	// where they are in the file, instead of ignoring them.
+	StrictConfig bool
+
+	// HTTPClient, if not nil, is copied to send the requests to the LAPI, with its
+	// transport wrapped by the authentication layer.
+	HTTPClient *http.Client
+	// Transport, if not nil, is the base transport instead of the one of HTTPClient.
+	// The TLS settings are applied to a copy of it if it's an *http.Transport, another
+	// kind of transport can't be used with TLS settings or certificate auth.
+	Transport http.RoundTripper
+	// WrapTransport, if not nil, is called with the transport built by the bouncer,
+	// before authentication, and returns the one to use, for tracing for example.
+	WrapTransport func(http.RoundTripper) http.RoundTripper
+
+	// MetricsRegisterer, if not nil, is where Init registers the Prometheus collectors of the
+	// bouncer, which are also returned by Collector. MetricsLabels are added to all of them,
+	// to tell apart several bouncers in the same process: Init fails if another bouncer has
+	// registered its collectors with the same labels.
+	MetricsRegisterer prometheus.Registerer
+	MetricsLabels     prometheus.Labels
+
+	cache    *decisionCache
+	breaker  *circuitBreaker
+	inflight lookupGroup
+	// shared by the lookups, to limit the warnings while the LAPI is down
+	failures  failureLog
+	endpoints *endpointSet
+	metrics   *bouncerMetrics
+
+	// protects the configuration while the bouncer is in use
+	mu       sync.RWMutex
+	reloadMu sync.Mutex
 }
 
 // Config() fills the struct with configuration values from a file. It is not
-// aware of .yaml.local files so it is recommended to use ConfigReader() instead.
+// aware of .yaml.local files so it is recommended to use ConfigReader() instead,
+// with NewConfigReader() to read the files.
 //
 // Deprecated: use ConfigReader() instead.
 func (b *LiveBouncer) Config(configPath string) error {
@@ -49,7 +118,12 @@ func (b *LiveBouncer) ConfigReader(configReader io.Reader) error {
 		return fmt.Errorf("unable to read configuration: %w", err)
 	}
 
-	err = yaml.Unmarshal(content, b)
+	if b.StrictConfig {
+		err = unmarshalStrict(content, b, yaml.Unmarshal)
+	} else {
+		err = yaml.Unmarshal(content, b)
+	}
+
 	if err != nil {
 		return fmt.Errorf("unable to unmarshal config file: %w", err)
 	}
@@ -62,36 +136,249 @@ func (b *LiveBouncer) ConfigReader(configReader io.Reader) error {
 }
 
 func (b *LiveBouncer) Init() error {
+	if err := b.prepare(); err != nil {
+		return err
+	}
+
 	var err error
 
-	// validate the configuration
+	b.metrics, err = newBouncerMetrics(b.MetricsLabels, b.MetricsRegisterer, b.metrics, false, b.BreakerState)
+	if err != nil {
+		return fmt.Errorf("metrics init: %w", err)
+	}
+
+	// created by prepare, before the metrics
+	if b.breaker != nil {
+		b.breaker.metrics = b.metrics
+	}
+
+	b.APIClient, b.endpoints, err = getAPIClient(b.apiClientConfig(), b.transportOptions(), logrus.StandardLogger())
+	if err != nil {
+		return fmt.Errorf("api client init: %w", err)
+	}
+
+	return nil
+}
 
-	if b.APIUrl == "" {
-		return errors.New("config does not contain LAPI url")
+// Validate checks the configuration and returns all the problems found, joined in a single
+// error. It does not modify the bouncer, and is called by Init and Reload.
+func (b *LiveBouncer) Validate() error {
+	errs := b.apiClientConfig().validate()
+
+	if err := b.validateFailurePolicy(); err != nil {
+		errs = append(errs, err)
 	}
 
-	if !strings.HasSuffix(b.APIUrl, "/") {
+	if b.Cache.Enabled {
+		if _, err := newDecisionCache(b.Cache); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if b.CircuitBreaker.Enabled {
+		if _, err := newCircuitBreaker(b.CircuitBreaker, nil); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// prepare validates the configuration and creates the cache and circuit breaker.
+func (b *LiveBouncer) prepare() error {
+	var err error
+
+	if err = b.Validate(); err != nil {
+		return err
+	}
+
+	if b.APIUrl != "" && !strings.HasSuffix(b.APIUrl, "/") {
 		b.APIUrl += "/"
 	}
 
-	if b.APIKey == "" && b.CertPath == "" && b.KeyPath == "" {
-		return errors.New("config does not contain LAPI key or certificate")
+	for i, apiURL := range b.APIUrls {
+		if !strings.HasSuffix(apiURL, "/") {
+			b.APIUrls[i] = apiURL + "/"
+		}
 	}
 
-	b.APIClient, err = getAPIClient(b.APIUrl, b.UserAgent, b.APIKey, b.CAPath, b.CertPath, b.KeyPath, b.InsecureSkipVerify, logrus.StandardLogger())
-	if err != nil {
-		return fmt.Errorf("api client init: %w", err)
+	b.cache = nil
+
+	if b.Cache.Enabled {
+		b.cache, err = newDecisionCache(b.Cache)
+		if err != nil {
+			return fmt.Errorf("cache init: %w", err)
+		}
+	}
+
+	b.breaker = nil
+
+	if b.CircuitBreaker.Enabled {
+		b.breaker, err = newCircuitBreaker(b.CircuitBreaker, b.metrics)
+		if err != nil {
+			return fmt.Errorf("circuit breaker init: %w", err)
+		}
 	}
 
 	return nil
 }
 
+func (b *LiveBouncer) transportOptions() transportOptions {
+	return transportOptions{
+		client:    b.HTTPClient,
+		transport: b.Transport,
+		wrap:      b.WrapTransport,
+		metrics:   b.metrics,
+	}
+}
+
+// Collector returns the Prometheus collectors of the bouncer, to register them if
+// MetricsRegisterer is not set. It is nil before Init.
+func (b *LiveBouncer) Collector() prometheus.Collector {
+	if b.metrics == nil {
+		return nil
+	}
+
+	return b.metrics
+}
+
+func (b *LiveBouncer) apiClientConfig() apiClientConfig {
+	return apiClientConfig{
+		URL:                b.APIUrl,
+		URLs:               strings.Join(b.APIUrls, " "),
+		LoadBalancing:      b.LoadBalancing,
+		UserAgent:          b.UserAgent,
+		APIKey:             b.APIKey,
+		APIKeyFile:         b.APIKeyFile,
+		APIKeyCommand:      b.APIKeyCommand,
+		CAPath:             b.CAPath,
+		CertPath:           b.CertPath,
+		KeyPath:            b.KeyPath,
+		InsecureSkipVerify: b.InsecureSkipVerify != nil && *b.InsecureSkipVerify,
+		CertExpiryWarnings: strings.Join(b.CertExpiryWarnings, ","),
+		TLSMinVersion:      b.TLS.MinVersion,
+		TLSMaxVersion:      b.TLS.MaxVersion,
+		TLSCipherSuites:    strings.Join(b.TLS.CipherSuites, ","),
+		TLSServerName:      b.TLS.ServerName,
+		TLSPinnedSHA256:    strings.Join(b.TLS.PinnedSHA256, ","),
+		ProxyURL:           b.ProxyURL,
+		NoProxy:            b.NoProxy,
+		Timeouts:           b.Timeouts,
+	}
+}
+
+// lookupSettings are the values used by Get, that can be changed by Reload.
+type lookupSettings struct {
+	client             *apiclient.ApiClient
+	cache              *decisionCache
+	breaker            *circuitBreaker
+	failurePolicy      string
+	failureRemediation string
+	failureLog         *failureLog
+}
+
+func (b *LiveBouncer) lookupSettings() lookupSettings {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return lookupSettings{
+		client:             b.APIClient,
+		cache:              b.cache,
+		breaker:            b.breaker,
+		failurePolicy:      b.FailurePolicy,
+		failureRemediation: b.FailureRemediation,
+		failureLog:         &b.failures,
+	}
+}
+
+// ActiveEndpoint returns the LAPI url that answered the last request, or the first
+// one if there has been no request yet.
+func (b *LiveBouncer) ActiveEndpoint() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.endpoints == nil {
+		return ""
+	}
+
+	return b.endpoints.Active()
+}
+
+// CacheStats returns the counters of the cache, or zero values if the cache is disabled.
+func (b *LiveBouncer) CacheStats() CacheStats {
+	cache := b.lookupSettings().cache
+	if cache == nil {
+		return CacheStats{}
+	}
+
+	return cache.stats()
+}
+
+// BreakerState returns the state of the circuit breaker. It is always closed
+// if the circuit breaker is disabled.
+func (b *LiveBouncer) BreakerState() BreakerState {
+	breaker := b.lookupSettings().breaker
+	if breaker == nil {
+		return BreakerClosed
+	}
+
+	return breaker.State()
+}
+
+// Get returns the decisions for an IP address. If the cache is enabled, the
+// response can be served from it, with the durations that remain since it has been
+// received: the returned value must not be modified.
+//
+// Concurrent calls for the same value share a single request to the LAPI.
+// If the request fails, the result depends on the failure policy.
 func (b *LiveBouncer) Get(ctx context.Context, value string) (*models.GetDecisionsResponse, error) {
+	settings := b.lookupSettings()
+
+	if settings.cache != nil {
+		if decisions, ok := settings.cache.get(value); ok {
+			return decisions, nil
+		}
+	}
+
+	decisions, err := b.inflight.do(ctx, value, func(ctx context.Context) (*models.GetDecisionsResponse, error) {
+		if settings.breaker != nil && !settings.breaker.allow() {
+			return nil, ErrCircuitOpen
+		}
+
+		decision, err := listDecisions(ctx, settings.client, value)
+
+		if settings.breaker != nil {
+			settings.breaker.record(err)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if settings.cache != nil {
+			settings.cache.set(value, decision)
+		}
+
+		return decision, nil
+	})
+	if err != nil {
+		// the caller gave up, there is no answer to give
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		return settings.onFailure(value, err)
+	}
+
+	return decisions, nil
+}
+
+func listDecisions(ctx context.Context, client *apiclient.ApiClient, value string) (*models.GetDecisionsResponse, error) {
 	filter := apiclient.DecisionsListOpts{
 		IPEquals: value,
 	}
 
-	decision, resp, err := b.APIClient.Decisions.List(ctx, filter)
+	decision, resp, err := client.Decisions.List(ctx, filter)
 	if err != nil {
 		if resp != nil && resp.Response != nil {
 			resp.Response.Body.Close()
@@ -0,0 +1,227 @@
+package csbouncer
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+const (
+	defaultCacheSize        = 10000
+	defaultCacheNegativeTTL = 10 * time.Second
+	defaultCacheMaxTTL      = time.Hour
+)
+
+// CacheConfig configures the cache in front of LiveBouncer.Get.
+type CacheConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// maximum number of values in the cache, the least recently used are evicted first
+	Size int `yaml:"size"`
+	// how long to remember that a value has no decision
+	NegativeTTL string `yaml:"negative_ttl"`
+	// upper bound for the lifetime of a cached decision, which is otherwise its remaining duration
+	MaxTTL string `yaml:"max_ttl"`
+}
+
+// CacheStats are the counters of the LiveBouncer cache.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// number of entries, including the expired ones that have not been evicted yet
+	Size int
+}
+
+type decisionCache struct {
+	mu          sync.Mutex
+	size        int
+	negativeTTL time.Duration
+	maxTTL      time.Duration
+	ll          *list.List
+	items       map[string]*list.Element
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+
+	// overridden by tests
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	key       string
+	decisions *models.GetDecisionsResponse
+	// when the response has been received, the durations are relative to it
+	received time.Time
+	expires  time.Time
+}
+
+// response returns a copy of the cached response, with the durations that remain at now,
+// as the LAPI would return them. The durations of the decisions that have expired, which
+// can be returned by getStale, are zero.
+func (e *cacheEntry) response(now time.Time) *models.GetDecisionsResponse {
+	if e.decisions == nil {
+		return nil
+	}
+
+	elapsed := now.Sub(e.received)
+	ret := make(models.GetDecisionsResponse, 0, len(*e.decisions))
+
+	for _, d := range *e.decisions {
+		c := *d
+
+		if d.Duration != nil {
+			if duration, err := time.ParseDuration(*d.Duration); err == nil {
+				remaining := max(duration-elapsed, 0).String()
+				c.Duration = &remaining
+			}
+		}
+
+		ret = append(ret, &c)
+	}
+
+	return &ret
+}
+
+func newDecisionCache(cfg CacheConfig) (*decisionCache, error) {
+	if cfg.Size < 0 {
+		return nil, errors.New("cache.size must not be negative")
+	}
+
+	size := cfg.Size
+	if size == 0 {
+		size = defaultCacheSize
+	}
+
+	negativeTTL, err := parseDuration("cache.negative_ttl", cfg.NegativeTTL, defaultCacheNegativeTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	maxTTL, err := parseDuration("cache.max_ttl", cfg.MaxTTL, defaultCacheMaxTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decisionCache{
+		size:        size,
+		negativeTTL: negativeTTL,
+		maxTTL:      maxTTL,
+		ll:          list.New(),
+		items:       make(map[string]*list.Element),
+		now:         time.Now,
+	}, nil
+}
+
+// ttl returns how long a response can be cached: the remaining duration of
+// the shortest decision, or the negative TTL if there is none.
+// The boolean is false if the response must not be cached.
+func (c *decisionCache) ttl(decisions *models.GetDecisionsResponse) (time.Duration, bool) {
+	if decisions == nil || len(*decisions) == 0 {
+		return c.negativeTTL, c.negativeTTL > 0
+	}
+
+	ttl := c.maxTTL
+
+	for _, d := range *decisions {
+		if d == nil || d.Duration == nil {
+			return 0, false
+		}
+
+		remaining, err := time.ParseDuration(*d.Duration)
+		if err != nil {
+			return 0, false
+		}
+
+		ttl = min(ttl, remaining)
+	}
+
+	return ttl, ttl > 0
+}
+
+func (c *decisionCache) get(key string) (*models.GetDecisionsResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+
+	// expired entries are kept until they are evicted or refreshed,
+	// they can still be served by getStale if the LAPI is unavailable
+	if !c.now().Before(entry.expires) {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(elem)
+	c.hits.Add(1)
+
+	return entry.response(c.now()), true
+}
+
+// getStale returns the last known response for a key, even if it has expired.
+func (c *decisionCache) getStale(key string) (*models.GetDecisionsResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	return elem.Value.(*cacheEntry).response(c.now()), true
+}
+
+func (c *decisionCache) set(key string, decisions *models.GetDecisionsResponse) {
+	ttl, ok := c.ttl(decisions)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	expires := now.Add(ttl)
+
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		entry.decisions = decisions
+		entry.received = now
+		entry.expires = expires
+		c.ll.MoveToFront(elem)
+
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&cacheEntry{key: key, decisions: decisions, received: now, expires: expires})
+
+	for c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+		c.evictions.Add(1)
+	}
+}
+
+func (c *decisionCache) stats() CacheStats {
+	c.mu.Lock()
+	size := c.ll.Len()
+	c.mu.Unlock()
+
+	return CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Size:      size,
+	}
+}
@@ -0,0 +1,111 @@
+package csbouncer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+func decisionsWithDuration(durations ...string) *models.GetDecisionsResponse {
+	ret := models.GetDecisionsResponse{}
+
+	for _, d := range durations {
+		ret = append(ret, &models.Decision{Duration: &d})
+	}
+
+	return &ret
+}
+
+func TestDecisionCacheTTL(t *testing.T) {
+	cache, err := newDecisionCache(CacheConfig{NegativeTTL: "5s", MaxTTL: "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.set("1.1.1.1", decisionsWithDuration())
+	cache.set("2.2.2.2", decisionsWithDuration("20s", "10s"))
+	cache.set("3.3.3.3", decisionsWithDuration("4h"))
+	cache.set("4.4.4.4", decisionsWithDuration("garbage"))
+
+	if _, ok := cache.get("4.4.4.4"); ok {
+		t.Error("a response with an invalid duration must not be cached")
+	}
+
+	now = now.Add(6 * time.Second)
+
+	if _, ok := cache.get("1.1.1.1"); ok {
+		t.Error("negative entry should have expired")
+	}
+
+	if _, ok := cache.get("2.2.2.2"); !ok {
+		t.Error("positive entry should still be cached")
+	}
+
+	now = now.Add(5 * time.Second)
+
+	if _, ok := cache.get("2.2.2.2"); ok {
+		t.Error("positive entry should expire with its shortest decision")
+	}
+
+	// the duration is the one that remains, as the LAPI would return it
+	if decisions, ok := cache.get("3.3.3.3"); !ok {
+		t.Error("positive entry should still be cached")
+	} else if *(*decisions)[0].Duration != "3h59m49s" {
+		t.Errorf("expected the remaining duration, got %s", *(*decisions)[0].Duration)
+	}
+
+	now = now.Add(time.Minute)
+
+	if _, ok := cache.get("3.3.3.3"); ok {
+		t.Error("positive entry should be capped by max_ttl")
+	}
+
+	stats := cache.stats()
+	if stats.Hits != 2 || stats.Misses != 4 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestDecisionCacheEviction(t *testing.T) {
+	cache, err := newDecisionCache(CacheConfig{Size: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache.set("1.1.1.1", decisionsWithDuration())
+	cache.set("2.2.2.2", decisionsWithDuration())
+
+	// 1.1.1.1 becomes the most recently used
+	if _, ok := cache.get("1.1.1.1"); !ok {
+		t.Fatal("expected a hit")
+	}
+
+	cache.set("3.3.3.3", decisionsWithDuration())
+
+	if _, ok := cache.get("2.2.2.2"); ok {
+		t.Error("the least recently used entry should have been evicted")
+	}
+
+	if _, ok := cache.get("1.1.1.1"); !ok {
+		t.Error("expected a hit")
+	}
+
+	stats := cache.stats()
+	if stats.Evictions != 1 || stats.Size != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestDecisionCacheConfig(t *testing.T) {
+	if _, err := newDecisionCache(CacheConfig{NegativeTTL: "ten seconds"}); err == nil {
+		t.Error("expected an error for an invalid duration")
+	}
+
+	if _, err := newDecisionCache(CacheConfig{Size: -1}); err == nil {
+		t.Error("expected an error for a negative size")
+	}
+}
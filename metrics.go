@@ -3,6 +3,7 @@ package csbouncer
 import (
 	"context"
 	"errors"
+	"net"
 	"net/http"
 	"time"
 
@@ -17,6 +18,9 @@ type MetricsUpdater func(*models.RemediationComponentsMetrics, time.Duration)
 
 const defaultMetricsInterval = 15 * time.Minute
 
+// used if the API client has no timeout
+const defaultMetricsTimeout = 10 * time.Second
+
 type MetricsProvider struct {
 	APIClient *apiclient.ApiClient
 	Interval  time.Duration
@@ -90,14 +94,19 @@ func (m *MetricsProvider) metricsPayload() *models.AllMetrics {
 }
 
 func (m *MetricsProvider) sendMetrics(ctx context.Context) {
-	ctxTime, cancel := context.WithTimeout(ctx, 10*time.Second)
+	timeout := defaultMetricsTimeout
+	if clientTimeout := m.APIClient.GetClient().Timeout; clientTimeout > 0 {
+		timeout = clientTimeout
+	}
+
+	ctxTime, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	met := m.metricsPayload()
 
 	_, resp, err := m.APIClient.UsageMetrics.Add(ctxTime, met)
 	switch {
-	case errors.Is(err, context.DeadlineExceeded):
+	case errors.Is(err, context.DeadlineExceeded) || isTimeout(err):
 		m.logger.Warnf("timeout sending metrics")
 	case resp != nil && resp.Response != nil && resp.Response.StatusCode == http.StatusNotFound:
 		m.logger.Warnf("metrics endpoint not found, older LAPI?")
@@ -110,6 +119,12 @@ func (m *MetricsProvider) sendMetrics(ctx context.Context) {
 	}
 }
 
+func isTimeout(err error) bool {
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 func (m *MetricsProvider) Run(ctx context.Context) error {
 	if m.Interval == 0 {
 		m.logger.Infof("usage metrics disabled")
@@ -0,0 +1,103 @@
+package csbouncer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// validateProxy checks the proxy settings.
+func (cfg apiClientConfig) validateProxy() error {
+	if cfg.ProxyURL == "" {
+		if cfg.NoProxy != "" {
+			return errors.New("no_proxy requires proxy_url")
+		}
+
+		return nil
+	}
+
+	proxyURL, err := url.Parse(cfg.ProxyURL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy_url: %w", err)
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("invalid proxy_url '%s': scheme must be http, https, socks5 or socks5h", proxyURL.Redacted())
+	}
+
+	if proxyURL.Host == "" {
+		return fmt.Errorf("invalid proxy_url '%s': no host", proxyURL.Redacted())
+	}
+
+	return nil
+}
+
+// proxyFunc returns the proxy to use for a request: the one from the configuration if any,
+// otherwise the one from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+func (cfg apiClientConfig) proxyFunc() func(*http.Request) (*url.URL, error) {
+	if cfg.ProxyURL == "" {
+		return http.ProxyFromEnvironment
+	}
+
+	proxy := (&httpproxy.Config{
+		HTTPProxy:  cfg.ProxyURL,
+		HTTPSProxy: cfg.ProxyURL,
+		NoProxy:    cfg.NoProxy,
+	}).ProxyFunc()
+
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
+
+// baseTransport returns the transport to build upon, with the proxy and timeout settings.
+// Without a transport from the application, it's a copy of http.DefaultTransport.
+func (o transportOptions) baseTransport(cfg apiClientConfig, timeouts timeoutSettings, logger logrus.FieldLogger) http.RoundTripper {
+	if cfg.ProxyURL != "" {
+		if proxyURL, err := url.Parse(cfg.ProxyURL); err == nil {
+			logger.Infof("Using proxy '%s'", proxyURL.Redacted())
+		}
+	}
+
+	base := o.base()
+
+	switch t := base.(type) {
+	case nil:
+		transport := &http.Transport{}
+
+		if defaultTransport, ok := http.DefaultTransport.(*http.Transport); ok {
+			transport = defaultTransport.Clone()
+		}
+
+		transport.Proxy = cfg.proxyFunc()
+		timeouts.apply(transport)
+
+		return transport
+	case *http.Transport:
+		if cfg.ProxyURL == "" && !timeouts.configured() {
+			return t
+		}
+
+		transport := t.Clone()
+
+		if cfg.ProxyURL != "" {
+			transport.Proxy = cfg.proxyFunc()
+		}
+
+		timeouts.apply(transport)
+
+		return transport
+	default:
+		if cfg.ProxyURL != "" || timeouts.configured() {
+			logger.Infof("the proxy and timeout settings are not applied to the custom transport %T", base)
+		}
+
+		return base
+	}
+}
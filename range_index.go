@@ -0,0 +1,255 @@
+package csbouncer
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/crowdsecurity/crowdsec/pkg/types"
+)
+
+// RangeIndex is a binary prefix trie of the decisions with a Range scope,
+// with one tree for IPv4 and one for IPv6. Lookups walk at most one node per
+// bit of the address, regardless of the number of ranges.
+//
+// It is safe for concurrent use.
+type RangeIndex struct {
+	mu    sync.RWMutex
+	v4    *rangeNode
+	v6    *rangeNode
+	count int
+}
+
+type rangeNode struct {
+	children [2]*rangeNode
+	// the prefix and its decisions, only set for the nodes that terminate a range
+	prefix    netip.Prefix
+	decisions map[string]*models.Decision
+}
+
+func NewRangeIndex() *RangeIndex {
+	return &RangeIndex{
+		v4: &rangeNode{},
+		v6: &rangeNode{},
+	}
+}
+
+// normalizePrefix returns the masked prefix, with IPv4-mapped IPv6 ranges converted to IPv4.
+func normalizePrefix(prefix netip.Prefix) netip.Prefix {
+	addr := prefix.Addr()
+	if addr.Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+	}
+
+	return prefix.Masked()
+}
+
+func rangePrefix(d *models.Decision) (netip.Prefix, bool) {
+	if d == nil || d.Scope == nil || d.Value == nil {
+		return netip.Prefix{}, false
+	}
+
+	if normalizeScope(*d.Scope) != normalizeScope(types.Range) {
+		return netip.Prefix{}, false
+	}
+
+	prefix, err := netip.ParsePrefix(*d.Value)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+
+	return normalizePrefix(prefix), true
+}
+
+// addrBit returns the n-th most significant bit of the address.
+func addrBit(addr netip.Addr, n int) int {
+	var b []byte
+
+	if addr.Is4() {
+		a := addr.As4()
+		b = a[:]
+	} else {
+		a := addr.As16()
+		b = a[:]
+	}
+
+	return int(b[n/8]>>(7-n%8)) & 1
+}
+
+func (r *RangeIndex) root(addr netip.Addr) *rangeNode {
+	if addr.Is4() {
+		return r.v4
+	}
+
+	return r.v6
+}
+
+// Apply updates the index with a response from the decision stream.
+// Decisions that don't have a Range scope are ignored.
+func (r *RangeIndex) Apply(resp *models.DecisionsStreamResponse) {
+	if resp == nil {
+		return
+	}
+
+	r.Delete(resp.Deleted...)
+	r.Add(resp.New...)
+}
+
+// Add inserts decisions in the index. Decisions that don't have a Range scope,
+// or an invalid value, are ignored.
+func (r *RangeIndex) Add(decisions ...*models.Decision) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, d := range decisions {
+		prefix, ok := rangePrefix(d)
+		if !ok {
+			continue
+		}
+
+		node := r.root(prefix.Addr())
+
+		for i := range prefix.Bits() {
+			bit := addrBit(prefix.Addr(), i)
+			if node.children[bit] == nil {
+				node.children[bit] = &rangeNode{}
+			}
+
+			node = node.children[bit]
+		}
+
+		if node.decisions == nil {
+			node.prefix = prefix
+			node.decisions = make(map[string]*models.Decision)
+		}
+
+		id := decisionID(d)
+		if _, ok := node.decisions[id]; !ok {
+			r.count++
+		}
+
+		node.decisions[id] = d
+	}
+}
+
+// Delete removes decisions from the index. Unknown decisions are ignored.
+func (r *RangeIndex) Delete(decisions ...*models.Decision) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, d := range decisions {
+		prefix, ok := rangePrefix(d)
+		if !ok {
+			continue
+		}
+
+		// keep the path to prune the empty branches
+		path := make([]*rangeNode, 0, prefix.Bits()+1)
+		node := r.root(prefix.Addr())
+		path = append(path, node)
+
+		for i := range prefix.Bits() {
+			node = node.children[addrBit(prefix.Addr(), i)]
+			if node == nil {
+				break
+			}
+
+			path = append(path, node)
+		}
+
+		if node == nil {
+			continue
+		}
+
+		id := decisionID(d)
+		if _, ok := node.decisions[id]; !ok {
+			continue
+		}
+
+		delete(node.decisions, id)
+		r.count--
+
+		if len(node.decisions) == 0 {
+			node.decisions = nil
+		}
+
+		for i := len(path) - 1; i > 0; i-- {
+			n := path[i]
+			if n.decisions != nil || n.children[0] != nil || n.children[1] != nil {
+				break
+			}
+
+			path[i-1].children[addrBit(prefix.Addr(), i-1)] = nil
+		}
+	}
+}
+
+// Lookup returns the decisions of all the ranges that contain the address,
+// from the most specific range to the least specific one.
+func (r *RangeIndex) Lookup(addr netip.Addr) []*models.Decision {
+	var matches [][]*models.Decision
+
+	r.walk(addr, func(n *rangeNode) {
+		matches = append(matches, collect(n.decisions))
+	})
+
+	var ret []*models.Decision
+
+	for _, decisions := range slices.Backward(matches) {
+		ret = append(ret, decisions...)
+	}
+
+	return ret
+}
+
+// LongestMatch returns the most specific range that contains the address, and
+// its decisions. The boolean is false if no range contains the address.
+func (r *RangeIndex) LongestMatch(addr netip.Addr) (netip.Prefix, []*models.Decision, bool) {
+	var (
+		prefix    netip.Prefix
+		decisions []*models.Decision
+	)
+
+	r.walk(addr, func(n *rangeNode) {
+		prefix = n.prefix
+		decisions = collect(n.decisions)
+	})
+
+	return prefix, decisions, decisions != nil
+}
+
+// walk calls fn for each node with decisions on the path of the address,
+// from the least specific to the most specific range, with the read lock held.
+func (r *RangeIndex) walk(addr netip.Addr, fn func(*rangeNode)) {
+	if !addr.IsValid() {
+		return
+	}
+
+	addr = addr.Unmap()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	node := r.root(addr)
+
+	for i := 0; node != nil; i++ {
+		if node.decisions != nil {
+			fn(node)
+		}
+
+		if i == addr.BitLen() {
+			break
+		}
+
+		node = node.children[addrBit(addr, i)]
+	}
+}
+
+// Len returns the number of decisions in the index.
+func (r *RangeIndex) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.count
+}
@@ -0,0 +1,108 @@
+package csbouncer_test
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+
+	csbouncer "github.com/crowdsecurity/go-cs-bouncer"
+)
+
+func TestRangeIndex(t *testing.T) {
+	idx := csbouncer.NewRangeIndex()
+
+	idx.Apply(&models.DecisionsStreamResponse{
+		New: models.GetDecisionsResponse{
+			newDecision(1, "Range", "10.0.0.0/8", "ban"),
+			newDecision(2, "Range", "10.1.0.0/16", "captcha"),
+			newDecision(3, "Range", "10.1.2.3/32", "ban"),
+			newDecision(4, "Range", "2001:db8::/32", "ban"),
+			newDecision(5, "Range", "::ffff:192.168.0.0/112", "ban"),
+			newDecision(6, "Range", "0.0.0.0/0", "captcha"),
+			// ignored
+			newDecision(7, "Ip", "10.1.2.3", "ban"),
+			newDecision(8, "Range", "not-a-range", "ban"),
+		},
+	})
+
+	if got := idx.Len(); got != 6 {
+		t.Fatalf("expected 6 decisions, got %d", got)
+	}
+
+	tests := []struct {
+		addr     string
+		expected []int64
+	}{
+		{"10.1.2.3", []int64{3, 2, 1, 6}},
+		{"10.1.2.4", []int64{2, 1, 6}},
+		{"10.2.0.1", []int64{1, 6}},
+		{"11.0.0.1", []int64{6}},
+		{"192.168.1.1", []int64{5, 6}},
+		{"::ffff:10.1.2.3", []int64{3, 2, 1, 6}},
+		{"2001:db8:1::1", []int64{4}},
+		{"2001:db9::1", nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.addr, func(t *testing.T) {
+			decisions := idx.Lookup(netip.MustParseAddr(tc.addr))
+
+			ids := make([]int64, 0, len(decisions))
+			for _, d := range decisions {
+				ids = append(ids, d.ID)
+			}
+
+			if fmt.Sprint(ids) != fmt.Sprint(tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, ids)
+			}
+		})
+	}
+
+	prefix, decisions, ok := idx.LongestMatch(netip.MustParseAddr("10.1.9.9"))
+	if !ok || prefix.String() != "10.1.0.0/16" || len(decisions) != 1 {
+		t.Errorf("unexpected longest match: %s %v %t", prefix, decisions, ok)
+	}
+
+	idx.Apply(&models.DecisionsStreamResponse{
+		Deleted: models.GetDecisionsResponse{
+			newDecision(2, "Range", "10.1.0.0/16", "captcha"),
+			newDecision(3, "Range", "10.1.2.3/32", "ban"),
+			newDecision(6, "Range", "0.0.0.0/0", "captcha"),
+			// unknown
+			newDecision(9, "Range", "10.1.0.0/16", "ban"),
+		},
+	})
+
+	if got := idx.Len(); got != 3 {
+		t.Fatalf("expected 3 decisions, got %d", got)
+	}
+
+	prefix, _, ok = idx.LongestMatch(netip.MustParseAddr("10.1.2.3"))
+	if !ok || prefix.String() != "10.0.0.0/8" {
+		t.Errorf("unexpected longest match after delete: %s %t", prefix, ok)
+	}
+
+	if _, _, ok = idx.LongestMatch(netip.MustParseAddr("11.0.0.1")); ok {
+		t.Error("expected no match after delete")
+	}
+}
+
+func BenchmarkRangeIndexLookup(b *testing.B) {
+	idx := csbouncer.NewRangeIndex()
+
+	var decisions []*models.Decision
+
+	for i := range 50000 {
+		decisions = append(decisions, newDecision(int64(i), "Range", fmt.Sprintf("%d.%d.%d.0/24", 1+i/65536, (i/256)%256, i%256), "ban"))
+	}
+
+	idx.Add(decisions...)
+
+	addr := netip.MustParseAddr("1.100.200.1")
+
+	for b.Loop() {
+		idx.Lookup(addr)
+	}
+}
@@ -0,0 +1,211 @@
+package csbouncer
+
+import (
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
+)
+
+// Reload reads a new configuration, validates it and applies it to the bouncer while Run
+// keeps going. The API client is rebuilt if the connection settings have changed, and the
+// next pull is a full resync if the decision filters have changed. If the new configuration
+// is not valid, an error is returned and the current one is kept.
+//
+// A MetricsProvider created with the previous APIClient is not updated.
+func (b *StreamBouncer) Reload(configReader io.Reader) error {
+	b.reloadMu.Lock()
+	defer b.reloadMu.Unlock()
+
+	b.mu.RLock()
+	nb := &StreamBouncer{
+		UserAgent:     b.UserAgent,
+		StrictConfig:  b.StrictConfig,
+		HTTPClient:    b.HTTPClient,
+		Transport:     b.Transport,
+		WrapTransport: b.WrapTransport,
+		metrics:       b.metrics,
+	}
+	// these are not part of the configuration file
+	nb.Opts.CommunityPull = b.Opts.CommunityPull
+	nb.Opts.AdditionalPull = b.Opts.AdditionalPull
+	currentClientConfig := b.apiClientConfig()
+	b.mu.RUnlock()
+
+	if err := nb.ConfigReader(configReader); err != nil {
+		return err
+	}
+
+	if err := nb.prepare(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	var (
+		client    *apiclient.ApiClient
+		endpoints *endpointSet
+		err       error
+	)
+
+	if nb.apiClientConfig() != currentClientConfig {
+		client, endpoints, err = getAPIClient(nb.apiClientConfig(), nb.transportOptions(), log.StandardLogger())
+		if err != nil {
+			return fmt.Errorf("api client init: %w", err)
+		}
+
+		log.Info("LAPI connection settings have changed, using a new API client")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if nb.Opts != b.Opts {
+		log.Info("decision filters have changed, a full resync will be done on the next pull")
+		b.resync.Store(true)
+	}
+
+	// the snapshot only tracks the decisions received while it's enabled
+	if nb.SnapshotPath != "" && b.SnapshotPath == "" {
+		log.Info("snapshot_path has been set, a full resync will be done on the next pull")
+		b.resync.Store(true)
+	}
+
+	b.APIKey = nb.APIKey
+	b.APIKeyFile = nb.APIKeyFile
+	b.APIKeyCommand = nb.APIKeyCommand
+	b.APIUrl = nb.APIUrl
+	b.APIUrls = nb.APIUrls
+	b.InsecureSkipVerify = nb.InsecureSkipVerify
+	b.CertPath = nb.CertPath
+	b.KeyPath = nb.KeyPath
+	b.CAPath = nb.CAPath
+	b.CertExpiryWarnings = nb.CertExpiryWarnings
+	b.TLS = nb.TLS
+	b.ProxyURL = nb.ProxyURL
+	b.NoProxy = nb.NoProxy
+	b.Timeouts = nb.Timeouts
+	b.RetryInitialConnect = nb.RetryInitialConnect
+	b.Retry = nb.Retry
+	b.TickerJitter = nb.TickerJitter
+	b.TickerIntervalMax = nb.TickerIntervalMax
+	b.FullResyncInterval = nb.FullResyncInterval
+	b.SnapshotPath = nb.SnapshotPath
+	b.TickerInterval = nb.TickerInterval
+	b.Scopes = nb.Scopes
+	b.ScenariosContaining = nb.ScenariosContaining
+	b.ScenariosNotContaining = nb.ScenariosNotContaining
+	b.Origins = nb.Origins
+
+	b.TickerIntervalDuration = nb.TickerIntervalDuration
+	b.Opts = nb.Opts
+	b.backoff = nb.backoff
+	b.tickerIntervalMax = nb.tickerIntervalMax
+	b.fullResyncInterval = nb.fullResyncInterval
+
+	if client != nil {
+		previous := b.endpoints
+
+		b.APIClient = client
+		b.endpoints = endpoints
+
+		// the requests in progress keep their connections, the idle ones won't be used anymore
+		if previous != nil {
+			previous.CloseIdleConnections()
+		}
+	}
+
+	return nil
+}
+
+// Reload reads a new configuration, validates it and applies it to the bouncer while it's
+// in use. The API client is rebuilt if the connection settings have changed, the cache and
+// circuit breaker are recreated if their settings have changed. If the new configuration
+// is not valid, an error is returned and the current one is kept.
+//
+// A MetricsProvider created with the previous APIClient is not updated.
+func (b *LiveBouncer) Reload(configReader io.Reader) error {
+	b.reloadMu.Lock()
+	defer b.reloadMu.Unlock()
+
+	b.mu.RLock()
+	nb := &LiveBouncer{
+		UserAgent:     b.UserAgent,
+		StrictConfig:  b.StrictConfig,
+		HTTPClient:    b.HTTPClient,
+		Transport:     b.Transport,
+		WrapTransport: b.WrapTransport,
+		metrics:       b.metrics,
+	}
+	currentClientConfig := b.apiClientConfig()
+	b.mu.RUnlock()
+
+	if err := nb.ConfigReader(configReader); err != nil {
+		return err
+	}
+
+	if err := nb.prepare(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	var (
+		client    *apiclient.ApiClient
+		endpoints *endpointSet
+		err       error
+	)
+
+	if nb.apiClientConfig() != currentClientConfig {
+		client, endpoints, err = getAPIClient(nb.apiClientConfig(), nb.transportOptions(), log.StandardLogger())
+		if err != nil {
+			return fmt.Errorf("api client init: %w", err)
+		}
+
+		log.Info("LAPI connection settings have changed, using a new API client")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// keep the content of the cache and the state of the circuit if possible
+	if nb.Cache != b.Cache || client != nil {
+		b.cache = nb.cache
+	}
+
+	if nb.CircuitBreaker != b.CircuitBreaker || client != nil {
+		b.breaker = nb.breaker
+	}
+
+	b.APIKey = nb.APIKey
+	b.APIKeyFile = nb.APIKeyFile
+	b.APIKeyCommand = nb.APIKeyCommand
+	b.APIUrl = nb.APIUrl
+	b.APIUrls = nb.APIUrls
+	b.InsecureSkipVerify = nb.InsecureSkipVerify
+	b.CertPath = nb.CertPath
+	b.KeyPath = nb.KeyPath
+	b.CAPath = nb.CAPath
+	b.CertExpiryWarnings = nb.CertExpiryWarnings
+	b.TLS = nb.TLS
+	b.ProxyURL = nb.ProxyURL
+	b.NoProxy = nb.NoProxy
+	b.Timeouts = nb.Timeouts
+	b.Cache = nb.Cache
+	b.CircuitBreaker = nb.CircuitBreaker
+	b.FailurePolicy = nb.FailurePolicy
+	b.FailureRemediation = nb.FailureRemediation
+	b.LoadBalancing = nb.LoadBalancing
+
+	if client != nil {
+		previous := b.endpoints
+
+		b.APIClient = client
+		b.endpoints = endpoints
+
+		// the requests in progress keep their connections, the idle ones won't be used anymore
+		if previous != nil {
+			previous.CloseIdleConnections()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package csbouncer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+// version of the format of the snapshot file, to be increased on incompatible changes
+const snapshotVersion = 1
+
+// decisionSnapshot is the content of the file written at snapshot_path.
+type decisionSnapshot struct {
+	Version int       `json:"version"`
+	SavedAt time.Time `json:"saved_at"`
+	// the Until field of each decision is set to its expiry
+	Decisions []*models.Decision `json:"decisions"`
+}
+
+// snapshotFile keeps track of the active decisions received by StreamBouncer, to save
+// them to disk and load them on the next startup if the LAPI can't be reached.
+type snapshotFile struct {
+	// copies of the decisions, with their expiry in Until
+	decisions *DecisionStore
+
+	// overridden by tests
+	now func() time.Time
+}
+
+func newSnapshotFile() *snapshotFile {
+	return &snapshotFile{
+		decisions: NewDecisionStore(),
+		now:       time.Now,
+	}
+}
+
+// withExpiry returns a copy of the decision with its expiry in Until, computed from the
+// duration, which is relative to the time the decision has been received.
+func withExpiry(d *models.Decision, now time.Time) *models.Decision {
+	c := *d
+
+	if d.Duration != nil {
+		if duration, err := time.ParseDuration(*d.Duration); err == nil {
+			c.Until = now.Add(duration).UTC().Format(time.RFC3339)
+		}
+	}
+
+	return &c
+}
+
+// update applies a response from the LAPI to the tracked decisions.
+func (s *snapshotFile) update(update *StreamUpdate) {
+	now := s.now()
+
+	decisions := make([]*models.Decision, 0, len(update.New))
+	for _, d := range update.New {
+		decisions = append(decisions, withExpiry(d, now))
+	}
+
+	if update.Snapshot {
+		s.decisions.Replace(decisions)
+		return
+	}
+
+	s.decisions.Apply(&models.DecisionsStreamResponse{New: decisions, Deleted: update.Deleted})
+}
+
+// save writes the tracked decisions to the file. The content is written to a temporary
+// file that replaces the previous one, so that the file is always complete.
+func (s *snapshotFile) save(path string) error {
+	now := s.now()
+
+	snapshot := decisionSnapshot{
+		Version:   snapshotVersion,
+		SavedAt:   now.UTC(),
+		Decisions: []*models.Decision{},
+	}
+
+	for _, d := range s.decisions.all() {
+		if until, err := time.Parse(time.RFC3339, d.Until); err == nil && !until.After(now) {
+			continue
+		}
+
+		snapshot.Decisions = append(snapshot.Decisions, d)
+	}
+
+	content, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("unable to encode the decisions: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("unable to write '%s': %w", path, err)
+	}
+
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to write '%s': %w", tmp.Name(), err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("unable to write '%s': %w", path, err)
+	}
+
+	return nil
+}
+
+// load reads the file written by save and tracks its decisions. It returns the ones that
+// have not expired, with their remaining duration, or nil if the file does not exist.
+func (s *snapshotFile) load(path string) ([]*models.Decision, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to read snapshot: %w", err)
+	}
+
+	var snapshot decisionSnapshot
+
+	if err := json.Unmarshal(content, &snapshot); err != nil {
+		return nil, fmt.Errorf("unable to decode snapshot '%s': %w", path, err)
+	}
+
+	if snapshot.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported version %d of snapshot '%s'", snapshot.Version, path)
+	}
+
+	now := s.now()
+
+	tracked := make([]*models.Decision, 0, len(snapshot.Decisions))
+	ret := make([]*models.Decision, 0, len(snapshot.Decisions))
+
+	for _, d := range snapshot.Decisions {
+		if d == nil {
+			continue
+		}
+
+		c := *d
+
+		if until, err := time.Parse(time.RFC3339, d.Until); err == nil {
+			remaining := until.Sub(now).Round(time.Second)
+			if remaining <= 0 {
+				continue
+			}
+
+			duration := remaining.String()
+			c.Duration = &duration
+		}
+
+		tracked = append(tracked, d)
+		ret = append(ret, &c)
+	}
+
+	s.decisions.Replace(tracked)
+
+	return ret, nil
+}
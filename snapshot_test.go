@@ -0,0 +1,161 @@
+package csbouncer
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+func testDecision(id int64, value string, duration string) *models.Decision {
+	scope, typ, origin, scenario := "Ip", "ban", "cscli", "manual"
+
+	return &models.Decision{
+		ID:       id,
+		Scope:    &scope,
+		Value:    &value,
+		Type:     &typ,
+		Origin:   &origin,
+		Scenario: &scenario,
+		Duration: &duration,
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.json")
+
+	now := time.Now().Truncate(time.Second)
+
+	s := newSnapshotFile()
+	s.now = func() time.Time { return now }
+
+	if decisions, err := s.load(path); err != nil || decisions != nil {
+		t.Fatalf("expected nothing without a file, got %v, %v", decisions, err)
+	}
+
+	s.update(&StreamUpdate{
+		DecisionsStreamResponse: &models.DecisionsStreamResponse{
+			New: models.GetDecisionsResponse{testDecision(1, "1.2.3.4", "1h"), testDecision(2, "5.6.7.8", "10m")},
+		},
+		Snapshot: true,
+	})
+
+	s.update(&StreamUpdate{
+		DecisionsStreamResponse: &models.DecisionsStreamResponse{
+			New:     models.GetDecisionsResponse{testDecision(3, "9.9.9.9", "2h")},
+			Deleted: models.GetDecisionsResponse{testDecision(1, "1.2.3.4", "1h")},
+		},
+	})
+
+	if err := s.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Fatalf("expected the temporary file to be renamed, got %d files", len(entries))
+	}
+
+	// 30 minutes later, decision 2 has expired
+	loaded := newSnapshotFile()
+	loaded.now = func() time.Time { return now.Add(30 * time.Minute) }
+
+	decisions, err := loaded.load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decisions) != 1 || *decisions[0].Value != "9.9.9.9" || *decisions[0].Duration != "1h30m0s" {
+		t.Fatalf("expected the remaining decision with its remaining duration, got %d decisions", len(decisions))
+	}
+
+	if err := os.WriteFile(path, []byte(`{"version":42,"decisions":[]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loaded.load(path); err == nil || !strings.Contains(err.Error(), "unsupported version 42") {
+		t.Fatalf("expected an error for an unknown version, got %v", err)
+	}
+}
+
+func TestStreamBouncerSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.json")
+
+	lapi := newFakeLAPI(t, func(url.Values) (int, string) {
+		return http.StatusOK, `{"new":[` +
+			`{"id":1,"duration":"1h","origin":"cscli","scenario":"manual","scope":"Ip","type":"ban","value":"1.2.3.4"},` +
+			`{"id":2,"duration":"1h","origin":"cscli","scenario":"manual","scope":"Ip","type":"ban","value":"5.6.7.8"}]}`
+	})
+
+	b := &StreamBouncer{
+		APIKey:         "key",
+		APIUrl:         lapi.URL,
+		TickerInterval: "1h",
+		SnapshotPath:   path,
+		Updates:        make(chan *StreamUpdate),
+	}
+
+	runStreamBouncer(t, b)
+
+	if update := <-b.Updates; update.Stale || len(update.New) != 2 {
+		t.Fatalf("expected the decisions from the LAPI, got %+v", update)
+	}
+
+	waitFor(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	})
+
+	// the LAPI is down on startup, then one of the decisions has been deleted
+	lapi.mu.Lock()
+	lapi.respond = func(url.Values) (int, string) {
+		return http.StatusServiceUnavailable, `{"message":"down"}`
+	}
+	lapi.mu.Unlock()
+
+	b = &StreamBouncer{
+		APIKey:         "key",
+		APIUrl:         lapi.URL,
+		TickerInterval: "1h",
+		SnapshotPath:   path,
+		Retry:          RetryConfig{InitialDelay: "10ms", MaxDelay: "10ms"},
+		Updates:        make(chan *StreamUpdate),
+		Store:          NewDecisionStore(),
+	}
+
+	runStreamBouncer(t, b)
+
+	update := <-b.Updates
+	if !update.Stale || !update.Snapshot || len(update.New) != 2 {
+		t.Fatalf("expected the saved decisions, got %+v", update)
+	}
+
+	if b.Store.Len() != 2 {
+		t.Fatalf("expected the saved decisions in the store, got %d", b.Store.Len())
+	}
+
+	waitFor(t, func() bool { return lapi.callCount() >= 3 })
+
+	lapi.mu.Lock()
+	lapi.respond = func(url.Values) (int, string) {
+		return http.StatusOK, `{"new":[{"id":1,"duration":"1h","origin":"cscli","scenario":"manual","scope":"Ip","type":"ban","value":"1.2.3.4"}]}`
+	}
+	lapi.mu.Unlock()
+
+	update = <-b.Updates
+	if update.Stale || !update.Snapshot || len(update.New) != 1 {
+		t.Fatalf("expected the decisions from the LAPI, got %+v", update)
+	}
+
+	if len(update.Deleted) != 1 || *update.Deleted[0].Value != "5.6.7.8" {
+		t.Fatalf("expected the stale decision to be deleted, got %v", update.Deleted)
+	}
+
+	if b.Store.Len() != 1 {
+		t.Fatalf("expected 1 decision in the store, got %d", b.Store.Len())
+	}
+}
@@ -5,8 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -17,11 +21,19 @@ import (
 	"github.com/crowdsecurity/crowdsec/pkg/models"
 )
 
+const defaultTickerInterval = 10 * time.Second
+
+// TotalLAPIError counts the failed requests of all the StreamBouncers, to be registered by the caller.
+//
+// Deprecated: use the collectors of each bouncer instead, with MetricsRegisterer or Collector.
 var TotalLAPIError = prometheus.NewCounter(prometheus.CounterOpts{
 	Name: "lapi_requests_failures_total",
 	Help: "The total number of failed calls to CrowdSec LAPI",
 })
 
+// TotalLAPICalls counts the requests of all the StreamBouncers, to be registered by the caller.
+//
+// Deprecated: use the collectors of each bouncer instead, with MetricsRegisterer or Collector.
 var TotalLAPICalls = prometheus.NewCounter(prometheus.CounterOpts{
 	Name: "lapi_requests_total",
 	Help: "The total number of calls to CrowdSec LAPI",
@@ -29,13 +41,55 @@ var TotalLAPICalls = prometheus.NewCounter(prometheus.CounterOpts{
 
 type StreamBouncer struct {
 	APIKey              string `yaml:"api_key"`
-	APIUrl              string `yaml:"api_url"`
+	APIUrl              string `yaml:"api_url"` // http(s)://host:port/ or unix:///path/to/socket
 	InsecureSkipVerify  *bool  `yaml:"insecure_skip_verify"`
 	CertPath            string `yaml:"cert_path"`
 	KeyPath             string `yaml:"key_path"`
 	CAPath              string `yaml:"ca_cert_path"`
 	RetryInitialConnect bool   `yaml:"retry_initial_connect"`
 
+	// several LAPI urls, in the order of priority, instead of api_url. The decisions are
+	// pulled from the first one that is healthy. After a switch to another LAPI, all the
+	// decisions are pulled again, since the deltas are tracked by each LAPI.
+	APIUrls []string `yaml:"api_urls"`
+
+	// read the API key from a file, which is read again when it changes, or from the
+	// output of a shell command, instead of api_key. Trailing newlines are removed.
+	APIKeyFile    string `yaml:"api_key_file"`
+	APIKeyCommand string `yaml:"api_key_command"`
+
+	// how long before the expiry of the client certificate or of the CA to log a warning,
+	// 720h (30 days), 168h (7 days) and 24h by default
+	CertExpiryWarnings []string `yaml:"cert_expiry_warnings"`
+
+	TLS TLSConfig `yaml:"tls"`
+
+	// HTTP CONNECT (http:// or https://) or SOCKS5 (socks5://) proxy to reach the LAPI,
+	// and comma-separated hosts that must not go through it. If not set, the HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY environment variables are used.
+	ProxyURL string `yaml:"proxy_url"`
+	NoProxy  string `yaml:"no_proxy"`
+
+	Timeouts TimeoutConfig `yaml:"timeouts"`
+
+	Retry RetryConfig `yaml:"retry"`
+
+	// random variation of the polling interval, as a fraction of it (0.1 means +/- 10%)
+	TickerJitter float64 `yaml:"update_frequency_jitter"`
+	// if set, the polling interval doubles after each empty response up to this value,
+	// and goes back to update_frequency as soon as there are new or deleted decisions
+	TickerIntervalMax string `yaml:"update_frequency_max"`
+
+	// if set, the full list of decisions is pulled again at this interval, to
+	// correct any drift between the LAPI and the state of the bouncer. On Stream, the
+	// decisions delivered before that are no longer active are sent in Deleted.
+	FullResyncInterval string `yaml:"full_resync_interval"`
+
+	// if set, the active decisions are saved to this file after each pull. On startup,
+	// they are loaded and delivered as a stale update before the first pull, and Run
+	// keeps retrying until the LAPI answers, even without retry_initial_connect.
+	SnapshotPath string `yaml:"snapshot_path"`
+
 	TickerInterval         string   `yaml:"update_frequency"`
 	Scopes                 []string `yaml:"scopes"`
 	ScenariosContaining    []string `yaml:"scenarios_containing"`
@@ -48,11 +102,62 @@ type StreamBouncer struct {
 	UserAgent              string
 	Opts                   apiclient.DecisionsStreamOpts
 
+	// Updates, if not nil, receives the same responses as Stream, with the
+	// information needed to apply them (see StreamUpdate).
+	Updates chan *StreamUpdate
+
+	// Store, if not nil, is kept up to date with the decisions received from the LAPI.
+	// When a store or the Updates channel are provided, Init does not create the Stream
+	// channel: set it explicitly if you want to read the deltas as well.
+	Store *DecisionStore
+
 	MetricsInterval time.Duration
+
+	// StrictConfig makes ConfigReader reject unknown or duplicate keys, reporting
+	// where they are in the file, instead of ignoring them, and Validate reject the
+	// scopes that are not built into CrowdSec.
+	StrictConfig bool
+
+	// HTTPClient, if not nil, is copied to send the requests to the LAPI, with its
+	// transport wrapped by the authentication layer.
+	HTTPClient *http.Client
+	// Transport, if not nil, is the base transport instead of the one of HTTPClient.
+	// The TLS settings are applied to a copy of it if it's an *http.Transport, another
+	// kind of transport can't be used with TLS settings or certificate auth.
+	Transport http.RoundTripper
+	// WrapTransport, if not nil, is called with the transport built by the bouncer,
+	// before authentication, and returns the one to use, for tracing for example.
+	WrapTransport func(http.RoundTripper) http.RoundTripper
+
+	// MetricsRegisterer, if not nil, is where Init registers the Prometheus collectors of the
+	// bouncer, which are also returned by Collector. MetricsLabels are added to all of them,
+	// to tell apart several bouncers in the same process: Init fails if another bouncer has
+	// registered its collectors with the same labels.
+	MetricsRegisterer prometheus.Registerer
+	MetricsLabels     prometheus.Labels
+
+	backoff            *backoff
+	tickerIntervalMax  time.Duration
+	fullResyncInterval time.Duration
+	endpoints          *endpointSet
+	snapshot           *snapshotFile
+	metrics            *bouncerMetrics
+	active             *activeDecisions
+
+	refresh chan chan error
+	resume  chan struct{}
+	paused  atomic.Bool
+
+	// protects the configuration while Run is active
+	mu       sync.RWMutex
+	reloadMu sync.Mutex
+	// a full pull is required because the filters have changed
+	resync atomic.Bool
 }
 
 // Config fills the struct with configuration values from a file. It is not
-// aware of .yaml.local files so it is recommended to use ConfigReader() instead.
+// aware of .yaml.local files so it is recommended to use ConfigReader() instead,
+// with NewConfigReader() to read the files.
 //
 // Deprecated: use ConfigReader() instead.
 func (b *StreamBouncer) Config(configPath string) error {
@@ -70,7 +175,12 @@ func (b *StreamBouncer) ConfigReader(configReader io.Reader) error {
 		return fmt.Errorf("unable to read configuration: %w", err)
 	}
 
-	err = yaml.Unmarshal(content, b)
+	if b.StrictConfig {
+		err = unmarshalStrict(content, b, yaml.Unmarshal)
+	} else {
+		err = yaml.Unmarshal(content, b)
+	}
+
 	if err != nil {
 		return fmt.Errorf("unable to unmarshal config file: %w", err)
 	}
@@ -83,20 +193,109 @@ func (b *StreamBouncer) ConfigReader(configReader io.Reader) error {
 }
 
 func (b *StreamBouncer) Init() error {
+	if err := b.prepare(); err != nil {
+		return err
+	}
+
+	// prepare the client object for the lapi
+
+	if b.Stream == nil && b.Store == nil && b.Updates == nil {
+		b.Stream = make(chan *models.DecisionsStreamResponse)
+	}
+
+	b.refresh = make(chan chan error)
+	b.resume = make(chan struct{}, 1)
+	b.snapshot = newSnapshotFile()
+
 	var err error
 
-	// validate the configuration
+	b.metrics, err = newBouncerMetrics(b.MetricsLabels, b.MetricsRegisterer, b.metrics, true, nil)
+	if err != nil {
+		return fmt.Errorf("metrics init: %w", err)
+	}
+
+	b.active = newActiveDecisions(b.metrics.active)
+
+	b.APIClient, b.endpoints, err = getAPIClient(b.apiClientConfig(), b.transportOptions(), log.StandardLogger())
+	if err != nil {
+		return fmt.Errorf("api client init: %w", err)
+	}
+
+	return nil
+}
+
+// Validate checks the configuration and returns all the problems found, joined in a single
+// error. It does not modify the bouncer, and is called by Init and Reload.
+func (b *StreamBouncer) Validate() error {
+	errs := b.apiClientConfig().validate()
+
+	for _, err := range validateScopes(b.Scopes) {
+		if b.StrictConfig {
+			errs = append(errs, err)
+		} else {
+			log.Warningf("%s, it must be a custom scope", err)
+		}
+	}
+
+	tickerInterval := defaultTickerInterval
+
+	if b.TickerInterval != "" {
+		d, err := time.ParseDuration(b.TickerInterval)
 
-	if b.APIUrl == "" {
-		return errors.New("config does not contain LAPI url")
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("unable to parse lapi update interval '%s': %w", b.TickerInterval, err))
+		case d <= 0:
+			errs = append(errs, errors.New("lapi update interval must be positive"))
+		default:
+			tickerInterval = d
+		}
 	}
 
-	if !strings.HasSuffix(b.APIUrl, "/") {
+	if b.TickerJitter < 0 || b.TickerJitter > 1 {
+		errs = append(errs, errors.New("lapi update interval jitter must be between 0 and 1"))
+	}
+
+	tickerIntervalMax, err := parseDuration("lapi max update interval", b.TickerIntervalMax, 0)
+	if err != nil {
+		errs = append(errs, err)
+	} else if tickerIntervalMax != 0 && tickerIntervalMax < tickerInterval {
+		errs = append(errs, errors.New("lapi max update interval must not be lower than the update interval"))
+	}
+
+	if _, err := parseDuration("full resync interval", b.FullResyncInterval, 0); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := newBackoff(b.Retry); err != nil {
+		errs = append(errs, err)
+	}
+
+	if b.SnapshotPath != "" {
+		if info, err := os.Stat(filepath.Dir(b.SnapshotPath)); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Errorf("snapshot_path: directory '%s' does not exist", filepath.Dir(b.SnapshotPath)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// prepare validates the configuration and computes the derived settings.
+func (b *StreamBouncer) prepare() error {
+	var err error
+
+	if err = b.Validate(); err != nil {
+		return err
+	}
+
+	if b.APIUrl != "" && !strings.HasSuffix(b.APIUrl, "/") {
 		b.APIUrl += "/"
 	}
 
-	if b.APIKey == "" && b.CertPath == "" && b.KeyPath == "" {
-		return errors.New("config does not contain LAPI key or certificate")
+	for i, apiURL := range b.APIUrls {
+		if !strings.HasSuffix(apiURL, "/") {
+			b.APIUrls[i] = apiURL + "/"
+		}
 	}
 
 	//  scopes, origins, etc.
@@ -120,9 +319,9 @@ func (b *StreamBouncer) Init() error {
 	// update_frequency or however it's called in the .yaml of the specific bouncer
 
 	if b.TickerInterval == "" {
-		log.Warning("lapi update interval is not defined, using default value of 10s")
+		log.Warningf("lapi update interval is not defined, using default value of %s", defaultTickerInterval)
 
-		b.TickerInterval = "10s"
+		b.TickerInterval = defaultTickerInterval.String()
 	}
 
 	b.TickerIntervalDuration, err = time.ParseDuration(b.TickerInterval)
@@ -130,24 +329,114 @@ func (b *StreamBouncer) Init() error {
 		return fmt.Errorf("unable to parse lapi update interval '%s': %w", b.TickerInterval, err)
 	}
 
-	if b.TickerIntervalDuration <= 0 {
-		return errors.New("lapi update interval must be positive")
+	b.tickerIntervalMax, err = parseDuration("lapi max update interval", b.TickerIntervalMax, 0)
+	if err != nil {
+		return err
 	}
 
-	// prepare the client object for the lapi
-
-	b.Stream = make(chan *models.DecisionsStreamResponse)
+	b.fullResyncInterval, err = parseDuration("full resync interval", b.FullResyncInterval, 0)
+	if err != nil {
+		return err
+	}
 
-	b.APIClient, err = getAPIClient(b.APIUrl, b.UserAgent, b.APIKey, b.CAPath, b.CertPath, b.KeyPath, b.InsecureSkipVerify, log.StandardLogger())
+	b.backoff, err = newBackoff(b.Retry)
 	if err != nil {
-		return fmt.Errorf("api client init: %w", err)
+		return err
 	}
 
 	return nil
 }
 
-func (b *StreamBouncer) getDecisionStream(ctx context.Context) (*models.DecisionsStreamResponse, *apiclient.Response, error) {
-	data, resp, err := b.APIClient.Decisions.GetStream(ctx, b.Opts)
+func (b *StreamBouncer) transportOptions() transportOptions {
+	return transportOptions{
+		client:    b.HTTPClient,
+		transport: b.Transport,
+		wrap:      b.WrapTransport,
+		metrics:   b.metrics,
+	}
+}
+
+// Collector returns the Prometheus collectors of the bouncer, to register them if
+// MetricsRegisterer is not set. It is nil before Init.
+func (b *StreamBouncer) Collector() prometheus.Collector {
+	if b.metrics == nil {
+		return nil
+	}
+
+	return b.metrics
+}
+
+func (b *StreamBouncer) apiClientConfig() apiClientConfig {
+	return apiClientConfig{
+		URL:                b.APIUrl,
+		URLs:               strings.Join(b.APIUrls, " "),
+		UserAgent:          b.UserAgent,
+		APIKey:             b.APIKey,
+		APIKeyFile:         b.APIKeyFile,
+		APIKeyCommand:      b.APIKeyCommand,
+		CAPath:             b.CAPath,
+		CertPath:           b.CertPath,
+		KeyPath:            b.KeyPath,
+		InsecureSkipVerify: b.InsecureSkipVerify != nil && *b.InsecureSkipVerify,
+		CertExpiryWarnings: strings.Join(b.CertExpiryWarnings, ","),
+		TLSMinVersion:      b.TLS.MinVersion,
+		TLSMaxVersion:      b.TLS.MaxVersion,
+		TLSCipherSuites:    strings.Join(b.TLS.CipherSuites, ","),
+		TLSServerName:      b.TLS.ServerName,
+		TLSPinnedSHA256:    strings.Join(b.TLS.PinnedSHA256, ","),
+		ProxyURL:           b.ProxyURL,
+		NoProxy:            b.NoProxy,
+		Timeouts:           b.Timeouts,
+	}
+}
+
+// pollSettings are the values used by Run, that can be changed by Reload.
+type pollSettings struct {
+	client              *apiclient.ApiClient
+	opts                apiclient.DecisionsStreamOpts
+	retryInitialConnect bool
+	backoff             *backoff
+	interval            time.Duration
+	intervalMax         time.Duration
+	jitter              float64
+	fullResyncInterval  time.Duration
+	endpoints           *endpointSet
+	snapshotPath        string
+}
+
+func (b *StreamBouncer) pollSettings() pollSettings {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return pollSettings{
+		client:              b.APIClient,
+		opts:                b.Opts,
+		retryInitialConnect: b.RetryInitialConnect,
+		backoff:             b.backoff,
+		interval:            b.TickerIntervalDuration,
+		intervalMax:         b.tickerIntervalMax,
+		jitter:              b.TickerJitter,
+		fullResyncInterval:  b.fullResyncInterval,
+		endpoints:           b.endpoints,
+		snapshotPath:        b.SnapshotPath,
+	}
+}
+
+// ActiveEndpoint returns the LAPI url that answered the last request, or the first
+// one if there has been no request yet.
+func (b *StreamBouncer) ActiveEndpoint() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.endpoints == nil {
+		return ""
+	}
+
+	return b.endpoints.Active()
+}
+
+func (b *StreamBouncer) getDecisionStream(ctx context.Context, client *apiclient.ApiClient, opts apiclient.DecisionsStreamOpts) (*models.DecisionsStreamResponse, *apiclient.Response, error) {
+	data, resp, err := client.Decisions.GetStream(ctx, opts)
 
 	TotalLAPICalls.Inc()
 
@@ -158,7 +447,8 @@ func (b *StreamBouncer) getDecisionStream(ctx context.Context) (*models.Decision
 	return data, resp, err
 }
 
-func (b *StreamBouncer) Run(ctx context.Context) error {
+// pollState is the state of Run between two pulls.
+type pollState struct {
 	// the first connection is different, because
 	//
 	// - we need to communicate it to the LAPI (Opts.Startup)
@@ -166,57 +456,306 @@ func (b *StreamBouncer) Run(ctx context.Context) error {
 	// and if the LAPI is not responding on the first connect:
 	//
 	// - depending on the configuration (RetryInitialConnect), according to the runner (systemd or other daemonizer)
-	//   we want the attempt to fail immediateley and quit instead of retrying. If there is a retry,
-	//   it's not an exponential backoff but linear, because this situation (API not available) is more likely
-	//   during boot, updates, configuration scripts, tests, etc. where short delays are more appropriate.
-	startup := true
+	//   we want the attempt to fail immediateley and quit instead of retrying.
+	//
+	// Failed attempts, during startup or later, are retried with an exponential backoff and jitter,
+	// so that a fleet of bouncers does not hit a recovering LAPI at the same time.
+	startup bool
+
+	// whether the next pull must retrieve all the active decisions: on startup,
+	// and then every FullResyncInterval
+	fullPull     bool
+	lastFullPull time.Time
+
+	// the LAPI of the last successful pull
+	lastEndpoint string
 
-	ticker := time.NewTicker(b.TickerIntervalDuration)
-	defer ticker.Stop()
+	// consecutive failed attempts
+	failures int
 
-	// no delay for the first connection
-	delay := time.After(0)
+	interval time.Duration
+	delay    <-chan time.Time
+
+	// decisions have been loaded from the snapshot file and must be reconciled
+	stale bool
+
+	// Refresh calls waiting for the next pull
+	waiters []chan error
+}
+
+func (b *StreamBouncer) Run(ctx context.Context) error {
+	stale, err := b.loadSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+
+	st := &pollState{
+		startup:  true,
+		fullPull: true,
+		interval: b.pollSettings().interval,
+		// no delay for the first connection
+		delay: time.After(0),
+		stale: stale,
+	}
 
 	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-delay:
+		due, err := b.wait(ctx, st)
+		if err != nil {
+			return err
 		}
 
-		b.Opts.Startup = startup
-
-		data, resp, err := b.getDecisionStream(ctx)
-		if resp != nil && resp.Response != nil {
-			resp.Response.Body.Close()
+		if !due {
+			continue
 		}
 
-		if err != nil {
-			if startup && b.RetryInitialConnect {
-				log.Errorf("failed to connect to LAPI, retrying in 10s: %s", err)
-				delay = time.After(10 * time.Second)
-				continue
-			}
+		settings := b.pollSettings()
 
-			if startup {
-				// close the stream
-				// this may cause the bouncer to exit
-				close(b.Stream)
+		data, err := b.pull(ctx, st, settings)
+		if err != nil {
+			if err := b.pullFailed(st, settings, err); err != nil {
 				return err
 			}
 
-			log.Error(err)
+			continue
+		}
+
+		st.failures = 0
 
+		if st.switched(settings.endpoints) {
 			continue
 		}
 
+		if err := b.pulled(ctx, st, settings, data); err != nil {
+			return err
+		}
+	}
+}
+
+// wait waits for the next pull, a Refresh or a Resume, and reports whether the pull is due.
+func (b *StreamBouncer) wait(ctx context.Context, st *pollState) (bool, error) {
+	select {
+	case <-ctx.Done():
+		notifyRefresh(st.waiters, ctx.Err())
+		return false, ctx.Err()
+	case <-st.delay:
+		if b.paused.Load() {
+			// wait for Resume or Refresh
+			st.delay = nil
+			return false, nil
+		}
+	case done := <-b.refresh:
+		st.waiters = append(st.waiters, done)
+	case <-b.resume:
+		// paused again before we got the signal
+		return !b.paused.Load(), nil
+	}
+
+	return true, nil
+}
+
+// pull gets the decisions from the LAPI, all of them if a full pull is due.
+func (b *StreamBouncer) pull(ctx context.Context, st *pollState, settings pollSettings) (*models.DecisionsStreamResponse, error) {
+	if settings.fullResyncInterval > 0 && !st.lastFullPull.IsZero() && time.Since(st.lastFullPull) >= settings.fullResyncInterval {
+		st.fullPull = true
+	}
+
+	// the filters have changed on reload
+	if b.resync.Swap(false) {
+		st.fullPull = true
+	}
+
+	opts := settings.opts
+	opts.Startup = st.fullPull
+
+	data, resp, err := b.getDecisionStream(ctx, settings.client, opts)
+	if resp != nil && resp.Response != nil {
+		resp.Response.Body.Close()
+	}
+
+	return data, err
+}
+
+// pullFailed schedules a new attempt after a failed pull, or returns the error if Run must stop.
+func (b *StreamBouncer) pullFailed(st *pollState, settings pollSettings, err error) error {
+	notifyRefresh(st.waiters, err)
+	st.waiters = nil
+
+	st.failures++
+
+	if (st.startup && !settings.retryInitialConnect && !st.stale) || settings.backoff.exhausted(st.failures) {
+		// close the stream
+		// this may cause the bouncer to exit
+		if b.Stream != nil {
+			close(b.Stream)
+		}
+
+		return err
+	}
+
+	retryDelay := settings.backoff.delay(st.failures)
+
+	if st.startup {
+		log.Errorf("failed to connect to LAPI, retrying in %s: %s", retryDelay.Round(time.Millisecond), err)
+	} else {
+		log.Errorf("failed to get decisions from LAPI, retrying in %s: %s", retryDelay.Round(time.Millisecond), err)
+	}
+
+	st.delay = time.After(retryDelay)
+
+	return nil
+}
+
+// switched reports whether the last pull was answered by another LAPI than the one before.
+// The deltas are tracked by each LAPI, the ones of another LAPI can't be applied: they are
+// dropped and all the decisions are pulled instead.
+func (st *pollState) switched(endpoints *endpointSet) bool {
+	if endpoints == nil {
+		return false
+	}
+
+	endpoint := endpoints.Active()
+	switched := st.lastEndpoint != "" && endpoint != st.lastEndpoint && !st.fullPull
+	st.lastEndpoint = endpoint
+
+	if !switched {
+		return false
+	}
+
+	log.Infof("LAPI endpoint has changed to %s, pulling all the decisions", endpoint)
+
+	st.fullPull = true
+	st.delay = time.After(0)
+
+	return true
+}
+
+// pulled delivers the decisions of a successful pull and schedules the next one.
+func (b *StreamBouncer) pulled(ctx context.Context, st *pollState, settings pollSettings, data *models.DecisionsStreamResponse) error {
+	b.metrics.observePull(data, time.Now())
+
+	if st.fullPull {
+		// the deleted decisions are not in the response, the consumers of Stream
+		// must be told about the ones they have received before
+		data.Deleted = append(data.Deleted, b.active.missing(data.New)...)
+	}
+
+	st.stale = false
+
+	update := &StreamUpdate{DecisionsStreamResponse: data, Snapshot: st.fullPull}
+
+	if err := b.deliver(ctx, update); err != nil {
+		notifyRefresh(st.waiters, err)
+		return err
+	}
+
+	if settings.snapshotPath != "" {
+		b.saveSnapshot(settings.snapshotPath, update)
+	}
+
+	if st.fullPull {
+		st.fullPull = false
+		st.lastFullPull = time.Now()
+	}
+
+	notifyRefresh(st.waiters, nil)
+	st.waiters = nil
+
+	st.startup = false
+	st.interval = settings.nextInterval(st.interval, data)
+	st.delay = time.After(jitter(st.interval, settings.jitter))
+
+	return nil
+}
+
+// loadSnapshot delivers the decisions saved in the snapshot file, if any, and reports
+// whether it did. The file can't always be read, this is not an error.
+func (b *StreamBouncer) loadSnapshot(ctx context.Context) (bool, error) {
+	path := b.pollSettings().snapshotPath
+	if path == "" {
+		return false, nil
+	}
+
+	decisions, err := b.snapshot.load(path)
+	if err != nil {
+		log.Warningf("unable to load the decisions saved before: %s", err)
+		return false, nil
+	}
+
+	if decisions == nil {
+		return false, nil
+	}
+
+	log.Infof("loaded %d decisions from %s, until the LAPI answers", len(decisions), path)
+
+	update := &StreamUpdate{
+		DecisionsStreamResponse: &models.DecisionsStreamResponse{New: decisions},
+		Snapshot:                true,
+		Stale:                   true,
+	}
+
+	if err := b.deliver(ctx, update); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// saveSnapshot writes the active decisions to the snapshot file after a pull.
+func (b *StreamBouncer) saveSnapshot(path string, update *StreamUpdate) {
+	b.snapshot.update(update)
+
+	// nothing has changed
+	if !update.Snapshot && len(update.New) == 0 && len(update.Deleted) == 0 {
+		return
+	}
+
+	if err := b.snapshot.save(path); err != nil {
+		log.Warningf("unable to save the decisions: %s", err)
+	}
+}
+
+// nextInterval returns the polling interval after a successful pull. In adaptive mode, it
+// slows down while the LAPI has nothing new, and gets back to the base interval otherwise.
+func (s pollSettings) nextInterval(current time.Duration, data *models.DecisionsStreamResponse) time.Duration {
+	if s.intervalMax == 0 {
+		return s.interval
+	}
+
+	if data != nil && (len(data.New) > 0 || len(data.Deleted) > 0) {
+		return s.interval
+	}
+
+	return min(2*current, s.intervalMax)
+}
+
+// deliver applies a response to the store, if any, and to the counts of active decisions,
+// and sends it to the channels.
+func (b *StreamBouncer) deliver(ctx context.Context, update *StreamUpdate) error {
+	b.active.apply(update)
+
+	if b.Store != nil {
+		if update.Snapshot {
+			b.Store.Replace(update.New)
+		} else {
+			b.Store.Apply(update.DecisionsStreamResponse)
+		}
+	}
+
+	if b.Stream != nil {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case b.Stream <- data:
+		case b.Stream <- update.DecisionsStreamResponse:
 		}
+	}
 
-		startup = false
-		delay = ticker.C
+	if b.Updates != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case b.Updates <- update:
+		}
 	}
+
+	return nil
 }
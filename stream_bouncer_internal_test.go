@@ -0,0 +1,288 @@
+package csbouncer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+func TestStreamBouncerAdaptiveInterval(t *testing.T) {
+	b := &StreamBouncer{
+		APIKey:            "key",
+		APIUrl:            "http://localhost:8080/",
+		TickerInterval:    "10s",
+		TickerIntervalMax: "35s",
+	}
+
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	empty := &models.DecisionsStreamResponse{}
+	nonEmpty := &models.DecisionsStreamResponse{Deleted: models.GetDecisionsResponse{{}}}
+
+	settings := b.pollSettings()
+	interval := settings.interval
+
+	for _, want := range []time.Duration{20 * time.Second, 35 * time.Second, 35 * time.Second} {
+		interval = settings.nextInterval(interval, empty)
+		if interval != want {
+			t.Fatalf("expected %s, got %s", want, interval)
+		}
+	}
+
+	if interval = settings.nextInterval(interval, nonEmpty); interval != 10*time.Second {
+		t.Fatalf("expected the base interval after a non-empty response, got %s", interval)
+	}
+
+	b.TickerIntervalMax = "5s"
+
+	if err := b.Init(); err == nil {
+		t.Fatal("expected an error when update_frequency_max is lower than update_frequency")
+	}
+}
+
+// fakeLAPI serves the decision stream endpoint, with the responses returned by the handler.
+type fakeLAPI struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	calls   []url.Values
+	respond func(query url.Values) (int, string)
+}
+
+func newFakeLAPI(t *testing.T, respond func(query url.Values) (int, string)) *fakeLAPI {
+	t.Helper()
+
+	f := &fakeLAPI{respond: respond}
+
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.calls = append(f.calls, r.URL.Query())
+		respond := f.respond
+		f.mu.Unlock()
+
+		status, body := respond(r.URL.Query())
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+
+	t.Cleanup(f.Close)
+
+	return f
+}
+
+func (f *fakeLAPI) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.calls)
+}
+
+func (f *fakeLAPI) lastCall() url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.calls[len(f.calls)-1]
+}
+
+func emptyStream(_ url.Values) (int, string) {
+	return http.StatusOK, `{"new":[],"deleted":[]}`
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for condition")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func runStreamBouncer(t *testing.T, b *StreamBouncer) {
+	t.Helper()
+
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		_ = b.Run(ctx)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestStreamBouncerRefreshPause(t *testing.T) {
+	lapi := newFakeLAPI(t, emptyStream)
+
+	b := &StreamBouncer{
+		APIKey:         "key",
+		APIUrl:         lapi.URL,
+		TickerInterval: "1h",
+		Store:          NewDecisionStore(),
+	}
+
+	runStreamBouncer(t, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	waitFor(t, func() bool { return lapi.callCount() == 1 })
+
+	if err := b.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := lapi.callCount(); got != 2 {
+		t.Fatalf("expected 2 calls, got %d", got)
+	}
+
+	b.Pause()
+
+	if !b.Paused() {
+		t.Fatal("expected the bouncer to be paused")
+	}
+
+	if err := b.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := lapi.callCount(); got != 3 {
+		t.Fatalf("refresh should work while paused, got %d calls", got)
+	}
+
+	b.Resume()
+
+	waitFor(t, func() bool { return lapi.callCount() == 4 })
+}
+
+func TestStreamBouncerFullResync(t *testing.T) {
+	lapi := newFakeLAPI(t, func(query url.Values) (int, string) {
+		if query.Get("startup") == "true" {
+			return http.StatusOK, `{"new":[{"id":1,"duration":"1h","origin":"cscli","scenario":"manual","scope":"Ip","type":"ban","value":"1.2.3.4"}]}`
+		}
+
+		return http.StatusOK, `{"new":[{"id":2,"duration":"1h","origin":"cscli","scenario":"manual","scope":"Ip","type":"ban","value":"5.6.7.8"}]}`
+	})
+
+	store := NewDecisionStore()
+
+	b := &StreamBouncer{
+		APIKey:             "key",
+		APIUrl:             lapi.URL,
+		TickerInterval:     "20ms",
+		FullResyncInterval: "100ms",
+		Updates:            make(chan *StreamUpdate),
+		Store:              store,
+	}
+
+	runStreamBouncer(t, b)
+
+	if b.Stream != nil {
+		t.Fatal("the stream should not be created when Updates is set")
+	}
+
+	update := <-b.Updates
+	if !update.Snapshot {
+		t.Fatal("the startup pull should be a snapshot")
+	}
+
+	update = <-b.Updates
+	if update.Snapshot {
+		t.Fatal("expected a delta")
+	}
+
+	if store.Len() != 2 {
+		t.Fatalf("expected 2 decisions in the store, got %d", store.Len())
+	}
+
+	for update = range b.Updates {
+		if update.Snapshot {
+			break
+		}
+	}
+
+	// the snapshot replaces the content of the store
+	if store.Len() != 1 || store.Get("Ip", "5.6.7.8") != nil {
+		t.Fatalf("unexpected store content after a snapshot: %d decisions", store.Len())
+	}
+
+	// and the decisions that are not active anymore are deleted, for the consumers of Stream
+	if len(update.Deleted) != 1 || *update.Deleted[0].Value != "5.6.7.8" {
+		t.Fatalf("expected the missing decision to be deleted, got %v", update.Deleted)
+	}
+}
+
+func TestStreamBouncerReload(t *testing.T) {
+	lapi1 := newFakeLAPI(t, emptyStream)
+	lapi2 := newFakeLAPI(t, emptyStream)
+
+	b := &StreamBouncer{}
+
+	err := b.ConfigReader(strings.NewReader("api_url: " + lapi1.URL + "\napi_key: key\nupdate_frequency: 1h\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.Store = NewDecisionStore()
+
+	runStreamBouncer(t, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	waitFor(t, func() bool { return lapi1.callCount() == 1 })
+
+	if err = b.Reload(strings.NewReader("api_url: " + lapi1.URL + "\napi_key: key\nupdate_frequency: -1s\n")); err == nil {
+		t.Fatal("expected an error for an invalid configuration")
+	}
+
+	if err = b.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if lapi1.lastCall().Get("startup") != "" {
+		t.Fatal("expected a delta pull")
+	}
+
+	err = b.Reload(strings.NewReader("api_url: " + lapi2.URL + "\napi_key: key\nupdate_frequency: 1h\nscopes: [ip, range]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if lapi1.callCount() != 2 || lapi2.callCount() != 1 {
+		t.Fatalf("expected the new LAPI to be used, got %d and %d calls", lapi1.callCount(), lapi2.callCount())
+	}
+
+	query := lapi2.lastCall()
+	if query.Get("startup") != "true" || query.Get("scopes") != "ip,range" {
+		t.Fatalf("expected a full pull with the new filters, got %v", query)
+	}
+}
@@ -0,0 +1,57 @@
+package csbouncer
+
+import (
+	"context"
+)
+
+// Refresh makes a running StreamBouncer pull the decisions from the LAPI without waiting
+// for the next tick, even if it is paused. It returns once the response has been
+// delivered to the stream (or the store), or with the error of the request.
+//
+// Refresh blocks until Run picks up the request or the context is canceled.
+func (b *StreamBouncer) Refresh(ctx context.Context) error {
+	done := make(chan error, 1)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case b.refresh <- done:
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-done:
+		return err
+	}
+}
+
+// Pause stops the periodic pulls until Resume is called. The state of the
+// bouncer is kept and Refresh can still be used while paused.
+func (b *StreamBouncer) Pause() {
+	b.paused.Store(true)
+}
+
+// Resume restarts the periodic pulls after Pause, starting with an immediate one.
+func (b *StreamBouncer) Resume() {
+	if !b.paused.CompareAndSwap(true, false) {
+		return
+	}
+
+	select {
+	case b.resume <- struct{}{}:
+	default:
+	}
+}
+
+// Paused reports whether the periodic pulls are paused.
+func (b *StreamBouncer) Paused() bool {
+	return b.paused.Load()
+}
+
+// notifyRefresh answers the pending Refresh calls.
+func notifyRefresh(waiters []chan error, err error) {
+	for _, done := range waiters {
+		done <- err
+	}
+}
@@ -0,0 +1,22 @@
+package csbouncer
+
+import (
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+// StreamUpdate is a response from the decision stream, sent to StreamBouncer.Updates.
+type StreamUpdate struct {
+	*models.DecisionsStreamResponse
+
+	// Snapshot is true when New contains all the active decisions: on startup, and
+	// for each periodic full resync. The consumer should replace its state atomically
+	// instead of merging the response into it, and can ignore Deleted, which contains the
+	// decisions delivered before that are no longer active.
+	Snapshot bool
+
+	// Stale is true for the decisions loaded from snapshot_path on startup, before the
+	// LAPI has answered. They were active when the file was written, and their durations
+	// have been reduced by the time elapsed since then. The next update is a snapshot,
+	// with the stale decisions that are no longer active in Deleted.
+	Stale bool
+}
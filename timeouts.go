@@ -0,0 +1,111 @@
+package csbouncer
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultRequestTimeout = 1 * time.Minute
+	// same as http.DefaultTransport
+	defaultDialTimeout = 30 * time.Second
+	defaultKeepAlive   = 30 * time.Second
+)
+
+// TimeoutConfig configures the timeouts of the requests and connections to the LAPI.
+// When a value is not set, the one of the transport is kept.
+type TimeoutConfig struct {
+	// maximum duration of a request, including reading the response, 1m by default
+	Request string `yaml:"request"`
+	// maximum duration to establish a connection
+	Dial string `yaml:"dial"`
+	// maximum duration of the TLS handshake
+	TLSHandshake string `yaml:"tls_handshake"`
+	// how long an idle connection is kept open
+	IdleConn string `yaml:"idle_conn"`
+	// interval of the TCP keepalive probes
+	KeepAlive string `yaml:"keepalive"`
+}
+
+type timeoutSettings struct {
+	request      time.Duration
+	dial         time.Duration
+	tlsHandshake time.Duration
+	idleConn     time.Duration
+	keepAlive    time.Duration
+}
+
+func (cfg TimeoutConfig) settings() (timeoutSettings, error) {
+	var (
+		s    timeoutSettings
+		errs []error
+		err  error
+	)
+
+	s.request, err = parseDuration("timeouts.request", cfg.Request, defaultRequestTimeout)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	s.dial, err = parseDuration("timeouts.dial", cfg.Dial, 0)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	s.tlsHandshake, err = parseDuration("timeouts.tls_handshake", cfg.TLSHandshake, 0)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	s.idleConn, err = parseDuration("timeouts.idle_conn", cfg.IdleConn, 0)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	s.keepAlive, err = parseDuration("timeouts.keepalive", cfg.KeepAlive, 0)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	return s, errors.Join(errs...)
+}
+
+// dialer returns the dialer for the new connections.
+func (s timeoutSettings) dialer() *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout:   defaultDialTimeout,
+		KeepAlive: defaultKeepAlive,
+	}
+
+	if s.dial > 0 {
+		dialer.Timeout = s.dial
+	}
+
+	if s.keepAlive > 0 {
+		dialer.KeepAlive = s.keepAlive
+	}
+
+	return dialer
+}
+
+// configured reports whether the transport must be modified.
+func (s timeoutSettings) configured() bool {
+	return s.dial > 0 || s.keepAlive > 0 || s.tlsHandshake > 0 || s.idleConn > 0
+}
+
+// apply sets the configured timeouts on the transport.
+func (s timeoutSettings) apply(transport *http.Transport) {
+	if s.dial > 0 || s.keepAlive > 0 {
+		transport.DialContext = s.dialer().DialContext
+	}
+
+	if s.tlsHandshake > 0 {
+		transport.TLSHandshakeTimeout = s.tlsHandshake
+	}
+
+	if s.idleConn > 0 {
+		transport.IdleConnTimeout = s.idleConn
+	}
+}
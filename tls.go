@@ -1,9 +1,14 @@
 package csbouncer
 
 import (
+	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
 
 	"github.com/sirupsen/logrus"
 )
@@ -33,3 +38,273 @@ func getCertPool(caPath string, logger logrus.FieldLogger) (*x509.CertPool, erro
 
 	return cp, nil
 }
+
+// tlsFiles keeps the client certificate and the CA bundle in sync with the files they are
+// read from, so they can be rotated without restarting the bouncer.
+type tlsFiles struct {
+	certPath string
+	keyPath  string
+	caPath   string
+	logger   logrus.FieldLogger
+
+	certWatcher *fileWatcher
+	keyWatcher  *fileWatcher
+	caWatcher   *fileWatcher
+
+	expiry   *certExpiryMonitor
+	settings tlsSettings
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	pool *x509.CertPool
+
+	// incremented each time the certificate or the CA bundle are replaced
+	generation atomic.Uint64
+}
+
+func newTLSFiles(cfg apiClientConfig, metrics *bouncerMetrics, logger logrus.FieldLogger) (*tlsFiles, error) {
+	var err error
+
+	f := &tlsFiles{
+		certPath: cfg.CertPath,
+		keyPath:  cfg.KeyPath,
+		caPath:   cfg.CAPath,
+		logger:   logger,
+	}
+
+	f.settings, err = cfg.tlsSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	thresholds, err := parseCertExpiryWarnings(cfg.CertExpiryWarnings)
+	if err != nil {
+		return nil, err
+	}
+
+	f.expiry = newCertExpiryMonitor(thresholds, metrics, logger)
+
+	f.pool, err = getCertPool(f.caPath, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.caPath != "" {
+		f.caWatcher = newFileWatcher(f.caPath)
+		f.expiry.observeCA(f.caPath)
+	}
+
+	if f.certPath != "" && f.keyPath != "" {
+		f.certWatcher = newFileWatcher(f.certPath)
+		f.keyWatcher = newFileWatcher(f.keyPath)
+
+		certificate, err := tls.LoadX509KeyPair(f.certPath, f.keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load certificate '%s' and key '%s': %w", f.certPath, f.keyPath, err)
+		}
+
+		f.cert = &certificate
+		f.expiry.observeKeyPair(f.certPath, f.cert)
+	}
+
+	f.expiry.check()
+
+	return f, nil
+}
+
+// reload reads the files that have changed, and reports whether the certificate or the CA
+// bundle have been replaced. If a file can't be loaded, the previous value is kept.
+// It also warns about the certificates that are about to expire.
+func (f *tlsFiles) reload() bool {
+	reloaded := false
+
+	// both must be checked, to not miss a change
+	certChanged := f.certWatcher != nil && f.certWatcher.changed()
+	keyChanged := f.keyWatcher != nil && f.keyWatcher.changed()
+
+	if certChanged || keyChanged {
+		certificate, err := tls.LoadX509KeyPair(f.certPath, f.keyPath)
+		if err != nil {
+			// the key may not have been written yet, it will be retried when it changes
+			f.logger.Warningf("unable to reload certificate '%s' and key '%s', keeping the previous one: %s", f.certPath, f.keyPath, err)
+		} else {
+			f.logger.Infof("certificate '%s' has changed, using the new one", f.certPath)
+
+			f.mu.Lock()
+			f.cert = &certificate
+			f.mu.Unlock()
+
+			f.expiry.observeKeyPair(f.certPath, &certificate)
+
+			reloaded = true
+		}
+	}
+
+	if f.caWatcher != nil && f.caWatcher.changed() {
+		pool, err := getCertPool(f.caPath, f.logger)
+		if err != nil {
+			f.logger.Warningf("unable to reload CA certificates, keeping the previous ones: %s", err)
+		} else {
+			f.logger.Infof("CA certificate '%s' has changed, using the new one", f.caPath)
+
+			f.mu.Lock()
+			f.pool = pool
+			f.mu.Unlock()
+
+			f.expiry.observeCA(f.caPath)
+
+			reloaded = true
+		}
+	}
+
+	f.expiry.check()
+
+	if reloaded {
+		f.generation.Add(1)
+	}
+
+	return reloaded
+}
+
+func (f *tlsFiles) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.cert, nil
+}
+
+// verifyConnection does the verification of the server certificate with the current CA bundle,
+// since RootCAs can't be changed once the connections have been created, and checks the pins.
+func (f *tlsFiles) verifyConnection(cs tls.ConnectionState, serverName string, verifyChain bool) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no certificate presented by the LAPI")
+	}
+
+	// without a verified chain, only the leaf is trusted to belong to the LAPI: anyone can
+	// append its public certificate to their own
+	pinned := cs.PeerCertificates[:1]
+
+	if verifyChain {
+		chains, err := f.verifyChain(cs.PeerCertificates, serverName)
+		if err != nil {
+			return err
+		}
+
+		pinned = nil
+
+		for _, chain := range chains {
+			pinned = append(pinned, chain...)
+		}
+	}
+
+	if len(f.settings.pins) > 0 {
+		return f.settings.verifyPins(pinned)
+	}
+
+	return nil
+}
+
+// verifyChain returns the chains from the certificates presented by the LAPI to the CA.
+func (f *tlsFiles) verifyChain(certs []*x509.Certificate, serverName string) ([][]*x509.Certificate, error) {
+	f.mu.RLock()
+	pool := f.pool
+	f.mu.RUnlock()
+
+	opts := x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+	}
+
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	return certs[0].Verify(opts)
+}
+
+// tlsConfig returns the TLS configuration for a LAPI, serverName is its host name.
+func (f *tlsFiles) tlsConfig(serverName string, insecureSkipVerify bool) *tls.Config {
+	if f.settings.serverName != "" {
+		serverName = f.settings.serverName
+	}
+
+	config := &tls.Config{
+		RootCAs:            f.pool,
+		InsecureSkipVerify: insecureSkipVerify,
+		ServerName:         f.settings.serverName,
+		MinVersion:         f.settings.minVersion,
+		MaxVersion:         f.settings.maxVersion,
+		CipherSuites:       f.settings.cipherSuites,
+	}
+
+	if f.cert != nil {
+		config.GetClientCertificate = f.clientCertificate
+	}
+
+	// the default verification would use the CA bundle loaded at startup, and ignores the pins
+	if (f.caPath != "" && !insecureSkipVerify) || len(f.settings.pins) > 0 {
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return f.verifyConnection(cs, serverName, !insecureSkipVerify)
+		}
+	}
+
+	return config
+}
+
+// transport returns an HTTP transport that uses the current certificate and CA bundle. The
+// TLS settings are applied to a copy of the base transport, which must be an *http.Transport
+// if there is any. Another kind of transport is used as is, for API key auth without settings.
+func (f *tlsFiles) transport(base http.RoundTripper, serverName string, insecureSkipVerify bool) (http.RoundTripper, error) {
+	var transport *http.Transport
+
+	switch t := base.(type) {
+	case nil:
+		transport = &http.Transport{}
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		if f.cert != nil {
+			return nil, fmt.Errorf("certificate auth requires an *http.Transport, got %T", base)
+		}
+
+		// ignoring them could turn off the pinning or the CA without notice
+		if f.caPath != "" || f.settings.configured() {
+			return nil, fmt.Errorf("the TLS settings can't be applied to the custom transport %T, an *http.Transport is required", base)
+		}
+
+		return base, nil
+	}
+
+	transport.TLSClientConfig = f.tlsConfig(serverName, insecureSkipVerify)
+
+	return &tlsReloadTransport{
+		files:     f,
+		Transport: transport,
+	}, nil
+}
+
+// tlsReloadTransport checks the TLS files before each request. When they have changed,
+// the idle connections are closed so that the next requests do a new handshake.
+type tlsReloadTransport struct {
+	files     *tlsFiles
+	Transport *http.Transport
+	// generation of the files used by the idle connections
+	generation atomic.Uint64
+}
+
+func (t *tlsReloadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the files can be shared by the transports of several endpoints
+	t.files.reload()
+
+	if generation := t.files.generation.Load(); t.generation.Swap(generation) != generation {
+		t.Transport.CloseIdleConnections()
+	}
+
+	return t.Transport.RoundTrip(req)
+}
+
+func (t *tlsReloadTransport) CloseIdleConnections() {
+	t.Transport.CloseIdleConnections()
+}
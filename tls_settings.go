@@ -0,0 +1,161 @@
+package csbouncer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TLSConfig contains the advanced TLS settings of the connection to the LAPI.
+type TLSConfig struct {
+	// minimum and maximum version of the protocol: 1.0, 1.1, 1.2 or 1.3
+	MinVersion string `yaml:"min_version"`
+	MaxVersion string `yaml:"max_version"`
+	// cipher suites allowed up to TLS 1.2, with the names of tls.CipherSuites() like
+	// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. The TLS 1.3 suites can't be configured.
+	CipherSuites []string `yaml:"cipher_suites"`
+	// name used to verify the certificate of the LAPI and sent with SNI, instead of the host of api_url
+	ServerName string `yaml:"server_name"`
+	// SHA-256 fingerprints of the public keys (SPKI) accepted in the certificate chain of the LAPI,
+	// in hex or base64. They are checked in addition to the CA, or alone with insecure_skip_verify,
+	// which is the safe way to connect to a LAPI with a self-signed certificate.
+	PinnedSHA256 []string `yaml:"pinned_sha256"`
+}
+
+// tlsSettings are the parsed values of TLSConfig.
+type tlsSettings struct {
+	minVersion   uint16
+	maxVersion   uint16
+	cipherSuites []uint16
+	serverName   string
+	pins         [][]byte
+}
+
+// configured reports whether a setting differs from the defaults of crypto/tls.
+func (s tlsSettings) configured() bool {
+	return s.minVersion != 0 || s.maxVersion != 0 || len(s.cipherSuites) > 0 || s.serverName != "" || len(s.pins) > 0
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(name string, value string) (uint16, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	version, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(value), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("unknown %s '%s', must be one of 1.0, 1.1, 1.2, 1.3", name, value)
+	}
+
+	return version, nil
+}
+
+func parseCipherSuite(name string) (uint16, error) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, nil
+		}
+	}
+
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return 0, fmt.Errorf("cipher suite '%s' is insecure", name)
+		}
+	}
+
+	return 0, fmt.Errorf("unknown cipher suite '%s'", name)
+}
+
+// parsePin decodes a fingerprint in hex, with or without colons, or in base64 with an optional "sha256/" prefix.
+func parsePin(value string) ([]byte, error) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "sha256/")
+
+	if pin, err := hex.DecodeString(strings.ReplaceAll(value, ":", "")); err == nil && len(pin) == sha256.Size {
+		return pin, nil
+	}
+
+	if pin, err := base64.StdEncoding.DecodeString(value); err == nil && len(pin) == sha256.Size {
+		return pin, nil
+	}
+
+	return nil, fmt.Errorf("invalid SHA-256 fingerprint '%s'", value)
+}
+
+// tlsSettings parses the TLS settings, returning all the problems found.
+func (cfg apiClientConfig) tlsSettings() (tlsSettings, error) {
+	var (
+		settings tlsSettings
+		errs     []error
+		err      error
+	)
+
+	settings.serverName = cfg.TLSServerName
+
+	settings.minVersion, err = parseTLSVersion("tls.min_version", cfg.TLSMinVersion)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	settings.maxVersion, err = parseTLSVersion("tls.max_version", cfg.TLSMaxVersion)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if settings.minVersion != 0 && settings.maxVersion != 0 && settings.minVersion > settings.maxVersion {
+		errs = append(errs, errors.New("tls.min_version must not be greater than tls.max_version"))
+	}
+
+	if cfg.TLSCipherSuites != "" {
+		for name := range strings.SplitSeq(cfg.TLSCipherSuites, ",") {
+			id, err := parseCipherSuite(name)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			settings.cipherSuites = append(settings.cipherSuites, id)
+		}
+	}
+
+	if cfg.TLSPinnedSHA256 != "" {
+		for value := range strings.SplitSeq(cfg.TLSPinnedSHA256, ",") {
+			pin, err := parsePin(value)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			settings.pins = append(settings.pins, pin)
+		}
+	}
+
+	return settings, errors.Join(errs...)
+}
+
+// verifyPins checks that one of the certificates of the LAPI has a pinned public key. They must
+// be the leaf, or a chain that has been verified.
+func (s tlsSettings) verifyPins(certs []*x509.Certificate) error {
+	for _, cert := range certs {
+		fingerprint := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+		for _, pin := range s.pins {
+			if bytes.Equal(fingerprint[:], pin) {
+				return nil
+			}
+		}
+	}
+
+	return errors.New("the certificate of the LAPI does not match any pinned public key")
+}
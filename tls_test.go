@@ -0,0 +1,475 @@
+package csbouncer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert creates a certificate signed by parent, or a self-signed CA if parent is nil.
+func newTestCert(t *testing.T, cn string, parent *testCert, notAfter time.Time) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{cn},
+	}
+
+	signer, signerKey := template, key
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) write(t *testing.T, certPath string, keyPath string) {
+	t.Helper()
+
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if keyPath == "" {
+		return
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// newTLSServer starts a server that requires a client certificate signed by ca, and
+// responds with the common name of the client certificate.
+func newTLSServer(t *testing.T, ca *testCert, serverCert *testCert) *httptest.Server {
+	t.Helper()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert.tlsCertificate()},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestTLSFilesReload(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "client.pem")
+	keyPath := filepath.Join(dir, "client-key.pem")
+	caPath := filepath.Join(dir, "ca.pem")
+
+	notAfter := time.Now().Add(time.Hour)
+
+	ca := newTestCert(t, "ca", nil, notAfter)
+	ca.write(t, caPath, "")
+	newTestCert(t, "client-1", ca, notAfter).write(t, certPath, keyPath)
+
+	server := newTLSServer(t, ca, newTestCert(t, "server", ca, notAfter))
+
+	files, err := newTLSFiles(apiClientConfig{CertPath: certPath, KeyPath: keyPath, CAPath: caPath}, nil, logrus.StandardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	for _, w := range []*fileWatcher{files.certWatcher, files.keyWatcher, files.caWatcher} {
+		w.now = func() time.Time { return now }
+	}
+
+	transport, err := files.transport(nil, "127.0.0.1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: transport}
+
+	get := func(url string) (string, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		buf := make([]byte, 64)
+		n, _ := resp.Body.Read(buf)
+
+		return string(buf[:n]), nil
+	}
+
+	if cn, err := get(server.URL); err != nil || cn != "client-1" {
+		t.Fatalf("expected client-1, got '%s' (%v)", cn, err)
+	}
+
+	// rotation of the client certificate: the idle connection must be closed
+	newTestCert(t, "client-2-rotated", ca, notAfter).write(t, certPath, keyPath)
+
+	now = now.Add(defaultFileCheckInterval)
+
+	if cn, err := get(server.URL); err != nil || cn != "client-2-rotated" {
+		t.Fatalf("expected client-2-rotated, got '%s' (%v)", cn, err)
+	}
+
+	// rotation of the CA: the new server is not trusted until the file changes
+	ca2 := newTestCert(t, "ca-2", nil, notAfter)
+	newTestCert(t, "client-3", ca2, notAfter).write(t, certPath, keyPath)
+	server2 := newTLSServer(t, ca2, newTestCert(t, "server-2", ca2, notAfter))
+
+	if _, err := get(server2.URL); err == nil {
+		t.Fatal("the server should not be trusted before the CA is reloaded")
+	}
+
+	// a PEM bundle with both CAs
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.der})
+	bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca2.der})...)
+
+	if err := os.WriteFile(caPath, bundle, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(defaultFileCheckInterval)
+
+	if cn, err := get(server2.URL); err != nil || cn != "client-3" {
+		t.Fatalf("expected client-3, got '%s' (%v)", cn, err)
+	}
+
+	// a broken certificate keeps the previous one
+	if err := os.WriteFile(certPath, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(defaultFileCheckInterval)
+
+	if cn, err := get(server2.URL); err != nil || cn != "client-3" {
+		t.Fatalf("expected client-3, got '%s' (%v)", cn, err)
+	}
+}
+
+func TestCertExpiryMonitor(t *testing.T) {
+	thresholds, err := parseCertExpiryWarnings("24h, 168h")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(thresholds) != 2 || thresholds[0] != 168*time.Hour {
+		t.Fatalf("expected thresholds sorted from the longest, got %v", thresholds)
+	}
+
+	if _, err := parseCertExpiryWarnings("24h,-1h"); err == nil {
+		t.Error("expected an error for a negative threshold")
+	}
+
+	logger, hook := logrustest.NewNullLogger()
+
+	metrics, err := newBouncerMetrics(nil, nil, nil, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := newCertExpiryMonitor(thresholds, metrics, logger)
+
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	notAfter := now.Add(10 * 24 * time.Hour)
+	ca := newTestCert(t, "ca", nil, notAfter)
+	m.observe("client", "/client.pem", []*x509.Certificate{ca.cert})
+
+	gauge := testutil.ToFloat64(metrics.certExpiry.WithLabelValues("client", "/client.pem"))
+	if gauge != float64(ca.cert.NotAfter.Unix()) {
+		t.Errorf("expected the expiry timestamp, got %f", gauge)
+	}
+
+	expected := []logrus.Level{}
+
+	step := func(d time.Duration, level ...logrus.Level) {
+		t.Helper()
+
+		now = now.Add(d)
+		m.check()
+
+		expected = append(expected, level...)
+
+		if len(hook.AllEntries()) != len(expected) {
+			t.Fatalf("expected %d log entries, got %d", len(expected), len(hook.AllEntries()))
+		}
+
+		if len(level) > 0 && hook.LastEntry().Level != level[0] {
+			t.Fatalf("expected level %s, got %s", level[0], hook.LastEntry().Level)
+		}
+	}
+
+	step(0)
+	step(3*24*time.Hour, logrus.WarnLevel)
+	step(time.Hour)
+	step(6*24*time.Hour, logrus.WarnLevel)
+	step(time.Hour)
+	step(24*time.Hour, logrus.ErrorLevel)
+	step(24 * time.Hour)
+
+	// a renewed certificate is monitored again
+	m.observe("client", "/client.pem", []*x509.Certificate{newTestCert(t, "ca", nil, now.Add(2*time.Hour)).cert})
+
+	step(0, logrus.WarnLevel)
+}
+
+func TestTLSPinsChain(t *testing.T) {
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.pem")
+
+	notAfter := time.Now().Add(time.Hour)
+	ca := newTestCert(t, "ca", nil, notAfter)
+	ca.write(t, caPath, "")
+	lapiCert := newTestCert(t, "lapi.internal", ca, notAfter)
+	attacker := newTestCert(t, "lapi.internal", nil, notAfter)
+
+	// the attacker presents its own certificate, followed by the public one of the LAPI
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{attacker.der, lapiCert.der},
+			PrivateKey:  attacker.key,
+		}},
+	}
+
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	lapiPin := sha256.Sum256(lapiCert.cert.RawSubjectPublicKeyInfo)
+	caPin := sha256.Sum256(ca.cert.RawSubjectPublicKeyInfo)
+
+	get := func(cfg apiClientConfig) error {
+		t.Helper()
+
+		files, err := newTLSFiles(cfg, nil, logrus.StandardLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		transport, err := files.transport(nil, "127.0.0.1", cfg.InsecureSkipVerify)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		return err
+	}
+
+	if err := get(apiClientConfig{InsecureSkipVerify: true, TLSPinnedSHA256: hex.EncodeToString(lapiPin[:])}); err == nil {
+		t.Error("without a verified chain, the pin must match the leaf")
+	}
+
+	// the pin of a CA is accepted only if the chain is verified
+	if err := get(apiClientConfig{InsecureSkipVerify: true, TLSPinnedSHA256: hex.EncodeToString(caPin[:])}); err == nil {
+		t.Error("the pin of a certificate that is not in a verified chain must not be accepted")
+	}
+
+	if err := get(apiClientConfig{CAPath: caPath, TLSPinnedSHA256: hex.EncodeToString(lapiPin[:])}); err == nil {
+		t.Error("the chain of the attacker must not be verified")
+	}
+}
+
+func TestTLSSettings(t *testing.T) {
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.pem")
+
+	notAfter := time.Now().Add(time.Hour)
+	ca := newTestCert(t, "ca", nil, notAfter)
+	ca.write(t, caPath, "")
+	serverCert := newTestCert(t, "lapi.internal", ca, notAfter)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert.tlsCertificate()},
+		MaxVersion:   tls.VersionTLS12,
+	}
+
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	spki := sha256.Sum256(serverCert.cert.RawSubjectPublicKeyInfo)
+	pin := hex.EncodeToString(spki[:])
+	caSPKI := sha256.Sum256(ca.cert.RawSubjectPublicKeyInfo)
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name    string
+		cfg     apiClientConfig
+		wantErr bool
+	}{
+		{
+			name:    "self-signed without pin",
+			cfg:     apiClientConfig{},
+			wantErr: true,
+		},
+		{
+			name: "pin with insecure_skip_verify",
+			cfg:  apiClientConfig{InsecureSkipVerify: true, TLSPinnedSHA256: "sha256/" + otherPin + "," + pin},
+		},
+		{
+			name:    "wrong pin with insecure_skip_verify",
+			cfg:     apiClientConfig{InsecureSkipVerify: true, TLSPinnedSHA256: otherPin},
+			wantErr: true,
+		},
+		{
+			name:    "pin does not bypass the CA",
+			cfg:     apiClientConfig{TLSPinnedSHA256: pin},
+			wantErr: true,
+		},
+		{
+			name: "CA and pin",
+			cfg:  apiClientConfig{CAPath: caPath, TLSPinnedSHA256: pin},
+		},
+		{
+			name: "pin of the CA with a verified chain",
+			cfg:  apiClientConfig{CAPath: caPath, TLSPinnedSHA256: hex.EncodeToString(caSPKI[:])},
+		},
+		{
+			name: "server name",
+			cfg:  apiClientConfig{CAPath: caPath, TLSServerName: "lapi.internal"},
+		},
+		{
+			name:    "wrong server name",
+			cfg:     apiClientConfig{CAPath: caPath, TLSServerName: "other.internal"},
+			wantErr: true,
+		},
+		{
+			name:    "min version",
+			cfg:     apiClientConfig{CAPath: caPath, TLSMinVersion: "1.3"},
+			wantErr: true,
+		},
+		{
+			name: "cipher suites",
+			cfg:  apiClientConfig{CAPath: caPath, TLSCipherSuites: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			files, err := newTLSFiles(tc.cfg, nil, logrus.StandardLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			transport, err := files.transport(nil, "127.0.0.1", tc.cfg.InsecureSkipVerify)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client := &http.Client{Transport: transport}
+
+			resp, err := client.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+
+			if tc.wantErr != (err != nil) {
+				t.Errorf("expected error: %t, got: %v", tc.wantErr, err)
+			}
+		})
+	}
+
+	cfg := apiClientConfig{
+		TLSMinVersion:   "1.3",
+		TLSMaxVersion:   "tls1.2",
+		TLSCipherSuites: "TLS_RSA_WITH_RC4_128_SHA,TLS_NOPE",
+		TLSPinnedSHA256: "AB:CD",
+	}
+
+	_, err := cfg.tlsSettings()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	for _, expected := range []string{
+		"tls.min_version must not be greater than tls.max_version",
+		"cipher suite 'TLS_RSA_WITH_RC4_128_SHA' is insecure",
+		"unknown cipher suite 'TLS_NOPE'",
+		"invalid SHA-256 fingerprint 'AB:CD'",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected '%s' in: %s", expected, err)
+		}
+	}
+}